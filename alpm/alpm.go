@@ -1,5 +1,5 @@
-// Package alpm provides a cgo wrapper around alpm for functions used
-// by the pkgupd server
+//go:build cgo
+
 package alpm
 
 /*
@@ -10,26 +10,11 @@ package alpm
 import "C"
 
 import "unsafe"
-import "regexp"
 import "os"
-import "bufio"
 import "sync"
 import "container/list"
-import "strings"
 import "fmt"
-
-// Remove duplicate strings from string list
-func deduplicateStringList(a []string) []string {
-	result := []string{}
-	seen := map[string]bool{}
-	for _, v := range a {
-		if _, ok := seen[v]; !ok {
-			result = append(result, v)
-			seen[v] = true
-		}
-	}
-	return result
-}
+import "errors"
 
 // Alpm represents a libalpm instance
 type Alpm struct {
@@ -49,122 +34,17 @@ type Alpm struct {
 	numdbs int
 }
 
-// Pkg represents a pacman package
-type Pkg struct {
-	// Name of the package
-	Name string
-	// Local version of the package
-	LocalVersion string
-	// Remote version of the package. If there is no remote
-	// package available this should be 0
-	RemoteVersion string
-	// This is true if the package has no entry in the local
-	// database or on any remote sync database
-	Foreign bool
-}
-
-// IsUpdatable checks if this package is updatable. If
-// remote version is zero this is always false.
-func (p *Pkg) IsUpdatable() bool {
-	return IsUpdatablePkg(p)
-}
-
-// ParsePacmanConf reads the specified pacman configuration and returns a map
-// with string keys and map values. The maps are map[string]interface{}.
-// interface{} is either string or a []string
-func ParsePacmanConf(conf string) (map[string]map[string]interface{}, error) {
-	// matches "[foo]" and puts "foo" in the first match group
-	sectionRE := regexp.MustCompile(`\[(.*)\]`)
-	// matches "key = val" or just "key"; puts "key" in the first match group
-	// and "val" (if it exists) in second match group
-	stateRE := regexp.MustCompile(`(\w*)\s*=?\s*(.*)`)
-	file, err := os.Open(conf)
-	if err != nil {
-		return nil, err
-	}
-	currentSection := "options"
-	var line string
-	confMap := make(map[string]map[string]interface{})
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line = scanner.Text()
-		line = strings.Trim(line, " \t\r\n")
-		if strings.HasPrefix(line, "#") || len(line) == 0 {
-			continue
-		}
-		sections := sectionRE.FindStringSubmatch(line)
-		if len(sections) > 0 {
-			currentSection = sections[1]
-			if _, ok := confMap[currentSection]; !ok {
-				confMap[currentSection] = make(map[string]interface{})
-			}
-			continue
-		}
-		states := stateRE.FindStringSubmatch(line)
-		key := states[1]
-		val := states[2]
-		if len(states) > 0 {
-			if key == "Include" || key == "Server" {
-				if _, ok := confMap[currentSection][key]; !ok {
-					confMap[currentSection][key] = []string{val}
-				} else {
-					confMap[currentSection][key] =
-						append(confMap[currentSection][key].([]string), val)
-				}
-			} else {
-				confMap[currentSection][key] = val
-			}
-		}
+// newPkg converts a package returned by goalpm
+func newPkg(upkg *C.upd_package, foreign bool) *Pkg {
+	var groups []string
+	for it := upkg.groups; it != nil; it = C.alpm_list_next(it) {
+		groups = append(groups, C.GoString((*C.char)(it.data)))
 	}
-	file.Close()
-	return confMap, nil
-}
-
-// GetServersFromConf searches all Include and Server directives
-// found in repo section in pacman.conf and returns a list of all servers
-// that correspond to this repository. Duplicate servers are discarded.
-// The required arguments is a map of the values under the repo section (conf),
-// the name of the repo (repo) and the architecture of the machine (arch).
-// BUG: This always returns the Included servers first and the the single
-// Server directives in the section, even if they are specified in a different
-// order
-func GetServersFromConf(conf map[string]interface{}, repo string, arch string) []string {
-	var ires []string
-	if _, ok := conf["Include"]; ok {
-		var scanner *bufio.Scanner
-		var line string
-		var serverEntry []string
-		for _, entry := range conf["Include"].([]string) {
-			file, err := os.Open(entry)
-			if err != nil {
-				continue
-			}
-			scanner = bufio.NewScanner(file)
-			for scanner.Scan() {
-				line = strings.Trim(scanner.Text(), " \t\r\n")
-				if strings.HasPrefix(line, "#") || len(line) == 0 {
-					continue
-				}
-				serverEntry = strings.Split(line, "=")
-				if len(serverEntry) == 2 {
-					serverURL := strings.Trim(serverEntry[1], " \t\r\n")
-					serverURL = strings.Replace(serverURL, "$repo", repo, -1)
-					serverURL = strings.Replace(serverURL, "$arch", arch, -1)
-					ires = append(ires, serverURL)
-				}
-			}
-			file.Close()
-		}
-	}
-	if _, ok := conf["Server"]; ok {
-		for _, entry := range conf["Server"].([]string) {
-			serverURL := strings.Trim(entry, " \t\r\n")
-			serverURL = strings.Replace(serverURL, "$repo", repo, -1)
-			serverURL = strings.Replace(serverURL, "$arch", arch, -1)
-			ires = append(ires, serverURL)
-		}
-	}
-	return deduplicateStringList(ires)
+	return &Pkg{C.GoString(upkg.name), C.GoString(upkg.loc_version),
+		C.GoString(upkg.rem_version), foreign, C.GoString(upkg.repo),
+		int64(upkg.builddate), C.GoString(upkg.desc), C.GoString(upkg.arch),
+		int64(upkg.download_size), int64(upkg.isize_delta),
+		C.GoString(upkg.packager), groups, C.GoString(upkg.url)}
 }
 
 // NewAlpm returns a new instance of the libalpm library. It requires a
@@ -191,89 +71,117 @@ func (a *Alpm) AddDatabase(name string, servers []string) error {
 	return nil
 }
 
-// GetUpdates returns a slice of package ([]*Pkg) that are updatable.
-// Only local packages with remote versions in a repo are included.
-func (a *Alpm) GetUpdates() []*Pkg {
+// pkgList converts and frees a package list of goalpm. If cerr is set
+// the packages could not be read and it is returned as error
+func pkgList(res *C.alpm_list_t, cerr *C.char, foreign bool) ([]*Pkg, error) {
+	if cerr != nil {
+		defer freeStr(cerr)
+		return nil, errors.New(C.GoString(cerr))
+	}
 	var pkglist []*Pkg
-
-	var upkg *C.upd_package
-	res := C.get_updates(a.dbs)
 	for it := res; it != nil; it = C.alpm_list_next(it) {
-		upkg = (*C.upd_package)(it.data)
-		pkglist = append(pkglist,
-			&Pkg{C.GoString(upkg.name),
-				C.GoString(upkg.loc_version),
-				C.GoString(upkg.rem_version), false})
+		pkglist = append(pkglist, newPkg((*C.upd_package)(it.data), foreign))
 	}
 	C.free_pkg_list(res)
-	return pkglist
+	return pkglist, nil
+}
+
+// GetUpdates returns a slice of package ([]*Pkg) that are updatable.
+// Only local packages with remote versions in a repo are included.
+// An error is returned if the local database could not be read.
+func (a *Alpm) GetUpdates() ([]*Pkg, error) {
+	var cerr *C.char
+	res := C.get_updates(a.dbs, &cerr)
+	return pkgList(res, cerr, false)
 }
 
 // GetUpdatesList is the same as GetUpdates but returns a container/list.List
 // instead of a slice.
-func (a *Alpm) GetUpdatesList() *list.List {
-	pkglist := list.New()
-
-	res := C.get_updates(a.dbs)
-	var upkg *C.upd_package
-	for it := res; it != nil; it = C.alpm_list_next(it) {
-		upkg = (*C.upd_package)(it.data)
-		pkglist.PushBack(&Pkg{C.GoString(upkg.name),
-			C.GoString(upkg.loc_version),
-			C.GoString(upkg.rem_version), false})
-	}
-	C.free_pkg_list(res)
-	return pkglist
-
+func (a *Alpm) GetUpdatesList() (*list.List, error) {
+	pkgs, err := a.GetUpdates()
+	return toList(pkgs), err
 }
 
-// GetForeign returns a slice of all foreign packages ([]*Pkg)
-func (a *Alpm) GetForeign() []*Pkg {
-	var pkglist []*Pkg
-
-	res := C.get_foreign(a.dbs)
-	var upkg *C.upd_package
-	for it := res; it != nil; it = C.alpm_list_next(it) {
-		upkg = (*C.upd_package)(it.data)
-		pkglist = append(pkglist,
-			&Pkg{C.GoString(upkg.name),
-				C.GoString(upkg.loc_version),
-				C.GoString(upkg.rem_version), true})
-	}
-	C.free_pkg_list(res)
-	return pkglist
+// GetForeign returns a slice of all foreign packages ([]*Pkg). An
+// error is returned if the local database could not be read.
+func (a *Alpm) GetForeign() ([]*Pkg, error) {
+	var cerr *C.char
+	res := C.get_foreign(a.dbs, &cerr)
+	return pkgList(res, cerr, true)
 }
 
 // GetForeignList is the same as GetForeign but returns a container/list.List
 // instead of a slice.
-func (a *Alpm) GetForeignList() *list.List {
-	pkglist := list.New()
+func (a *Alpm) GetForeignList() (*list.List, error) {
+	pkgs, err := a.GetForeign()
+	return toList(pkgs), err
+}
 
-	res := C.get_foreign(a.dbs)
-	var upkg *C.upd_package
-	for it := res; it != nil; it = C.alpm_list_next(it) {
-		upkg = (*C.upd_package)(it.data)
-		pkglist.PushBack(&Pkg{C.GoString(upkg.name),
-			C.GoString(upkg.loc_version),
-			C.GoString(upkg.rem_version), false})
+// toList copies the packages into a container/list.List
+func toList(pkgs []*Pkg) *list.List {
+	pkglist := list.New()
+	for _, p := range pkgs {
+		pkglist.PushBack(p)
 	}
-	C.free_pkg_list(res)
 	return pkglist
 }
 
+// dbSyncStates maps the states of goalpm to the ones of DBSyncResult
+var dbSyncStates = map[int]string{0: DBUpdated, 1: DBUpToDate, -1: DBFailed}
+
 // SyncDBs synchronizes the databases. Set force to true to redownload
-// the databases even if they are up-to-date. Returns true if all
-// databases are already up to date.
-func (a *Alpm) SyncDBs(force bool) bool {
+// the databases even if they are up-to-date. The servers of every
+// database are tried in order until one succeeds. Returns the result
+// of every database and an error if any failed to synchronize. If
+// libalpm cannot be initialized the results are nil.
+func (a *Alpm) SyncDBs(force bool) ([]*DBSyncResult, error) {
 	_force := 0
 	if force {
 		_force = 1
 	}
-	ret := C.sync_dbs(a.dbs, C.int(_force))
-	if int(ret) != a.numdbs {
-		return true
+	var cerr *C.char
+	res := C.sync_dbs(a.dbs, C.int(_force), &cerr)
+	if cerr != nil {
+		defer freeStr(cerr)
+		return nil, errors.New(C.GoString(cerr))
 	}
-	return false
+	defer C.free_db_sync_results(res)
+	var results []*DBSyncResult
+	for it := res; it != nil; it = C.alpm_list_next(it) {
+		r := (*C.db_sync_result)(it.data)
+		results = append(results, &DBSyncResult{C.GoString(r.name),
+			dbSyncStates[int(r.state)], C.GoString(r.error), C.GoString(r.server),
+			int64(r.bytes), float64(r.duration)})
+	}
+	return results, dbSyncError(results)
+}
+
+// PreviewSysupgrade prepares a system upgrade transaction on the
+// sandbox without committing it and returns the packages it would
+// install and remove, or the conflicts and unresolvable dependencies
+// preventing it. The caller must hold the mutex since the databases
+// must not change during the preview.
+func (a *Alpm) PreviewSysupgrade() (*Preview, error) {
+	var cerr *C.char
+	res := C.preview_sysupgrade(a.dbs, &cerr)
+	if res == nil {
+		defer freeStr(cerr)
+		return nil, errors.New(C.GoString(cerr))
+	}
+	defer C.free_preview(res)
+	preview := &Preview{[]*Pkg{}, []*Pkg{}, []*Problem{}}
+	for it := res.add; it != nil; it = C.alpm_list_next(it) {
+		preview.Add = append(preview.Add, newPkg((*C.upd_package)(it.data), false))
+	}
+	for it := res.remove; it != nil; it = C.alpm_list_next(it) {
+		preview.Remove = append(preview.Remove, newPkg((*C.upd_package)(it.data), false))
+	}
+	for it := res.problems; it != nil; it = C.alpm_list_next(it) {
+		problem := (*C.preview_problem)(it.data)
+		preview.Problems = append(preview.Problems, &Problem{C.GoString(problem._type),
+			C.GoString(problem._package), C.GoString(problem.detail)})
+	}
+	return preview, nil
 }
 
 // GetGroupPackageNames returns a slice of string including all the
@@ -295,29 +203,24 @@ func (a *Alpm) GetGroupPackageNames(group string) []string {
 // both IngorePkg and IgnoreGroup. IgnoreGroup packages are expanded to
 // the included packages.
 func (a *Alpm) GetIgnoredPackageNames(conf map[string]map[string]interface{}) []string {
-	ignoredPkgs := []string{}
-	if val, ok := conf["options"]["IgnorePkg"].(string); ok {
-		for _, v := range strings.Split(val, " ") {
-			ignoredPkgs = append(ignoredPkgs, strings.Trim(v, " \t\r\n"))
-		}
-	}
+	return ignoredPackageNames(a, conf)
+}
 
-	if val, ok := conf["options"]["IgnoreGroup"].(string); ok {
-		var grp string
-		var grpPkgs []string
-		for _, v := range strings.Split(val, " ") {
-			grp = strings.Trim(v, " \t\r\n")
-			fmt.Printf("Ignoring group '%s' packages\n", grp)
-			grpPkgs = a.GetGroupPackageNames(grp)
-			fmt.Println(grpPkgs)
-			ignoredPkgs = append(ignoredPkgs, grpPkgs...)
-		}
-	}
-	return ignoredPkgs
+// Lock acquires the mutex of the database write operations
+func (a *Alpm) Lock() {
+	a.Mutex.Lock()
+}
+
+// Unlock releases the mutex of the database write operations
+func (a *Alpm) Unlock() {
+	a.Mutex.Unlock()
 }
 
-// Close deinitializes libalpm and frees allocated resources
+// Close deinitializes libalpm and frees allocated resources. It
+// waits for write operations holding the mutex to finish
 func (a *Alpm) Close() {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
 	C.free_syncdb_list(a.dbs)
 	a.numdbs = 0
 	C.goalpm_cleanup()
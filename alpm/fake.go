@@ -0,0 +1,153 @@
+package alpm
+
+import "sync"
+
+// FakeBackend is an in-memory Backend for tests. The packages it
+// returns and the outcome of its syncs are set with the Set methods,
+// which may be called while services use the backend. It counts the
+// calls of every method.
+type FakeBackend struct {
+	updates    []*Pkg
+	foreign    []*Pkg
+	groups     map[string][]string
+	syncResult []*DBSyncResult
+	syncErr    error
+	readErr    error
+	calls      map[string]int
+	dbMutex    *sync.Mutex
+	mutex      *sync.Mutex
+}
+
+// NewFakeBackend returns a FakeBackend without packages or databases
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{groups: make(map[string][]string), calls: make(map[string]int),
+		dbMutex: &sync.Mutex{}, mutex: &sync.Mutex{}}
+}
+
+// Calls returns the number of calls of method
+func (f *FakeBackend) Calls(method string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls[method]
+}
+
+// SetUpdates sets the packages returned by GetUpdates
+func (f *FakeBackend) SetUpdates(pkgs []*Pkg) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.updates = pkgs
+}
+
+// SetForeign sets the packages returned by GetForeign
+func (f *FakeBackend) SetForeign(pkgs []*Pkg) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.foreign = pkgs
+}
+
+// SetGroup sets the names of the packages of a group
+func (f *FakeBackend) SetGroup(group string, names []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.groups[group] = names
+}
+
+// SetSyncResult sets the values returned by SyncDBs
+func (f *FakeBackend) SetSyncResult(results []*DBSyncResult, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.syncResult = results
+	f.syncErr = err
+}
+
+// Lock acquires the mutex of the database write operations
+func (f *FakeBackend) Lock() {
+	f.dbMutex.Lock()
+}
+
+// Unlock releases the mutex of the database write operations
+func (f *FakeBackend) Unlock() {
+	f.dbMutex.Unlock()
+}
+
+// Close does nothing since the fake holds no resources
+func (f *FakeBackend) Close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls["Close"]++
+}
+
+// AddDatabase does nothing since the fake has no databases
+func (f *FakeBackend) AddDatabase(name string, servers []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls["AddDatabase"]++
+	return nil
+}
+
+// SetReadError sets the error returned by GetUpdates and GetForeign,
+// nil to return the packages again
+func (f *FakeBackend) SetReadError(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.readErr = err
+}
+
+// GetUpdates returns a copy of the packages set by SetUpdates
+func (f *FakeBackend) GetUpdates() ([]*Pkg, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls["GetUpdates"]++
+	if f.readErr != nil {
+		return nil, f.readErr
+	}
+	return copyPkgs(f.updates), nil
+}
+
+// GetForeign returns a copy of the packages set by SetForeign. The
+// remote versions of the copies can be changed without affecting
+// later calls
+func (f *FakeBackend) GetForeign() ([]*Pkg, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls["GetForeign"]++
+	if f.readErr != nil {
+		return nil, f.readErr
+	}
+	return copyPkgs(f.foreign), nil
+}
+
+// SyncDBs returns the values set by SetSyncResult
+func (f *FakeBackend) SyncDBs(force bool) ([]*DBSyncResult, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls["SyncDBs"]++
+	return f.syncResult, f.syncErr
+}
+
+// GetGroupPackageNames returns the names set by SetGroup
+func (f *FakeBackend) GetGroupPackageNames(group string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls["GetGroupPackageNames"]++
+	return append([]string{}, f.groups[group]...)
+}
+
+// GetIgnoredPackageNames returns the packages ignored by conf,
+// expanding the groups set by SetGroup
+func (f *FakeBackend) GetIgnoredPackageNames(conf map[string]map[string]interface{}) []string {
+	f.mutex.Lock()
+	f.calls["GetIgnoredPackageNames"]++
+	f.mutex.Unlock()
+	return ignoredPackageNames(f, conf)
+}
+
+// copyPkgs copies the packages so callers may modify them
+func copyPkgs(pkgs []*Pkg) []*Pkg {
+	var ret []*Pkg
+	for _, p := range pkgs {
+		c := *p
+		ret = append(ret, &c)
+	}
+	return ret
+}
@@ -1,8 +1,13 @@
+//go:build cgo
+
+#define _POSIX_C_SOURCE 200809L
+
 #include <alpm.h>
 #include <stdlib.h>
 #include <string.h>
 #include <stdarg.h>
 #include <assert.h>
+#include <time.h>
 #include "goalpm.h"
 
 typedef struct _paths_t {
@@ -93,6 +98,13 @@ static void free_pkg(void* pkg) {
 	free(pkgg->name);
 	free(pkgg->rem_version);
 	free(pkgg->loc_version);
+	free(pkgg->repo);
+	free(pkgg->desc);
+	free(pkgg->arch);
+	free(pkgg->packager);
+	free(pkgg->url);
+	alpm_list_free_inner(pkgg->groups, free);
+	alpm_list_free(pkgg->groups);
 	free(pkgg);
 	pkgg = NULL;
 }
@@ -163,26 +175,77 @@ static int is_foreign(alpm_handle_t* handle, alpm_pkg_t* pkg) {
 	return 1;
 }
 
-alpm_list_t* get_updates(alpm_list_t* syncdbs){
+/* new_upd_package describes the update of the local package pkg to
+ * the sync package spkg. If spkg is NULL the package is foreign and
+ * only the local name and version are known. If pkg is NULL the sync
+ * package is not installed yet */
+static upd_package* new_upd_package(alpm_pkg_t* pkg, alpm_pkg_t* spkg) {
+	alpm_list_t* it = NULL;
+	upd_package* upkg = (upd_package*)calloc(1, sizeof(upd_package));
+	upkg->name = _strdup(alpm_pkg_get_name(pkg ? pkg : spkg));
+	upkg->loc_version = _strdup(pkg ? alpm_pkg_get_version(pkg) : "0");
+	if(spkg == NULL) {
+		upkg->rem_version = _strdup("0");
+		return upkg;
+	}
+	upkg->rem_version = _strdup(alpm_pkg_get_version(spkg));
+	upkg->repo = _strdup(alpm_db_get_name(alpm_pkg_get_db(spkg)));
+	upkg->builddate = alpm_pkg_get_builddate(spkg);
+	upkg->desc = _strdup(alpm_pkg_get_desc(spkg));
+	upkg->arch = _strdup(alpm_pkg_get_arch(spkg));
+	upkg->packager = _strdup(alpm_pkg_get_packager(spkg));
+	upkg->url = _strdup(alpm_pkg_get_url(spkg));
+	for(it = alpm_pkg_get_groups(spkg); it; it = alpm_list_next(it)) {
+		upkg->groups = alpm_list_add(upkg->groups, _strdup(it->data));
+	}
+	upkg->download_size = alpm_pkg_download_size(spkg);
+	upkg->isize_delta = alpm_pkg_get_isize(spkg);
+	if(pkg != NULL) {
+		upkg->isize_delta -= alpm_pkg_get_isize(pkg);
+	}
+	return upkg;
+}
+
+/* Creates a handle with the sync dbs registered and reads the local
+ * packages into pkgs. Returns NULL and sets error if libalpm could not
+ * be initialized or the local database could not be read */
+static alpm_handle_t* open_local_pkgs(alpm_list_t* syncdbs, alpm_list_t** pkgs,
+		char** error) {
+	alpm_handle_t* handle = create_handle();
+	if(handle == NULL) {
+		*error = _strdup("could not initialize libalpm");
+		return NULL;
+	}
+	/* read before the sync dbs are registered so that the error is
+	 * not one of a sync db */
+	*pkgs = alpm_db_get_pkgcache(alpm_get_localdb(handle));
+	if(*pkgs == NULL && alpm_errno(handle) != ALPM_ERR_OK) {
+		*error = _strdup(alpm_strerror(alpm_errno(handle)));
+		alpm_release(handle);
+		return NULL;
+	}
+	register_sync_dbs(handle, syncdbs);
+	return handle;
+}
+
+alpm_list_t* get_updates(alpm_list_t* syncdbs, char** error){
 	alpm_list_t *it = NULL;
 	alpm_list_t *ret = NULL;
+	alpm_list_t *pkgs = NULL;
 	alpm_pkg_t *pkg = NULL;
 	alpm_pkg_t *spkg = NULL;
 
-	alpm_handle_t* handle = create_handle();
-	alpm_db_t *localdb = alpm_get_localdb(handle);
-	register_sync_dbs(handle, syncdbs);
+	alpm_handle_t* handle = open_local_pkgs(syncdbs, &pkgs, error);
+	if(handle == NULL) {
+		return NULL;
+	}
 
-	for(it = alpm_db_get_pkgcache(localdb); it; it=alpm_list_next(it)){
+	for(it = pkgs; it; it=alpm_list_next(it)){
 		pkg = it->data;
 		spkg = alpm_sync_get_new_version(pkg, alpm_get_syncdbs(handle));
 		if(spkg != NULL) {
 			/****** LEAK? ******/
-			upd_package* upkg = (upd_package*)malloc(sizeof(upd_package));
-			upkg->name = _strdup(alpm_pkg_get_name(pkg));
-			upkg->loc_version = _strdup(alpm_pkg_get_version(pkg));
-			upkg->rem_version = _strdup(alpm_pkg_get_version(spkg));
-			ret = alpm_list_add(ret, upkg);
+			ret = alpm_list_add(ret, new_upd_package(pkg, spkg));
 			/****** LEAK? ******/
 		}
 	}
@@ -191,28 +254,150 @@ alpm_list_t* get_updates(alpm_list_t* syncdbs){
 	return ret;
 }
 
-alpm_list_t* get_foreign(alpm_list_t* syncdbs){
+alpm_list_t* get_foreign(alpm_list_t* syncdbs, char** error){
 	alpm_list_t *it = NULL;
 	alpm_list_t *ret = NULL;
+	alpm_list_t *pkgs = NULL;
 	alpm_pkg_t *pkg = NULL;
 
-	alpm_handle_t* handle = create_handle();
-	alpm_db_t *localdb = alpm_get_localdb(handle);
-	register_sync_dbs(handle, syncdbs);
-	for(it = alpm_db_get_pkgcache(localdb); it; it = alpm_list_next(it)) {
+	alpm_handle_t* handle = open_local_pkgs(syncdbs, &pkgs, error);
+	if(handle == NULL) {
+		return NULL;
+	}
+	for(it = pkgs; it; it = alpm_list_next(it)) {
 		pkg = it->data;
 		if(is_foreign(handle, pkg)){
-			upd_package* upkg = (upd_package*)malloc(sizeof(upd_package));
-			upkg->name = _strdup(alpm_pkg_get_name(pkg));
-			upkg->loc_version = _strdup(alpm_pkg_get_version(pkg));
-			upkg->rem_version = _strdup("0");
-			ret = alpm_list_add(ret, upkg);
+			ret = alpm_list_add(ret, new_upd_package(pkg, NULL));
 		}
 	}
 	alpm_release(handle);
 	return ret;
 }
 
+static preview_problem* new_preview_problem(const char* type,
+		const char* package, const char* detail) {
+	preview_problem* problem = (preview_problem*)calloc(1, sizeof(preview_problem));
+	problem->type = _strdup(type);
+	problem->package = _strdup(package);
+	problem->detail = _strdup(detail);
+	return problem;
+}
+
+static void free_preview_problem(void* data) {
+	preview_problem* problem = (preview_problem*)data;
+	free(problem->type);
+	free(problem->package);
+	free(problem->detail);
+	free(problem);
+}
+
+void free_preview(preview_result* preview) {
+	free_pkg_list(preview->add);
+	free_pkg_list(preview->remove);
+	alpm_list_free_inner(preview->problems, free_preview_problem);
+	alpm_list_free(preview->problems);
+	free(preview);
+}
+
+/* answer_question answers like pacman --noconfirm would, except that
+ * replacements are accepted so they show up in the preview */
+static void answer_question(void* ctx, alpm_question_t* question) {
+	switch(question->type) {
+		case ALPM_QUESTION_REPLACE_PKG:
+			question->replace.replace = 1;
+			break;
+		case ALPM_QUESTION_SELECT_PROVIDER:
+			question->select_provider.use_index = 0;
+			break;
+		default:
+			question->any.answer = 0;
+	}
+}
+
+/* preview_sysupgrade prepares a sysupgrade transaction without
+ * committing it. The packages to install and to remove are returned
+ * if the transaction could be prepared, otherwise the reasons why it
+ * could not. Errors that are not about the transaction are returned
+ * in error */
+preview_result* preview_sysupgrade(alpm_list_t* syncdbs, char** error) {
+	alpm_list_t *it = NULL;
+	alpm_list_t *data = NULL;
+	alpm_pkg_t *spkg = NULL;
+	alpm_errno_t err;
+
+	alpm_handle_t* handle = create_handle();
+	if(handle == NULL) {
+		*error = _strdup("could not initialize libalpm");
+		return NULL;
+	}
+	alpm_db_t *localdb = alpm_get_localdb(handle);
+	register_sync_dbs(handle, syncdbs);
+	alpm_option_set_questioncb(handle, answer_question, NULL);
+
+	/* the transaction is never committed so the database is not locked */
+	if(alpm_trans_init(handle, ALPM_TRANS_FLAG_NOLOCK) != 0) {
+		*error = _strdup(alpm_strerror(alpm_errno(handle)));
+		alpm_release(handle);
+		return NULL;
+	}
+	if(alpm_sync_sysupgrade(handle, 0) != 0) {
+		*error = _strdup(alpm_strerror(alpm_errno(handle)));
+		alpm_trans_release(handle);
+		alpm_release(handle);
+		return NULL;
+	}
+
+	preview_result* preview = (preview_result*)calloc(1, sizeof(preview_result));
+	if(alpm_trans_prepare(handle, &data) != 0) {
+		err = alpm_errno(handle);
+		switch(err) {
+			case ALPM_ERR_UNSATISFIED_DEPS:
+				for(it = data; it; it = alpm_list_next(it)) {
+					alpm_depmissing_t *miss = it->data;
+					char *depstring = alpm_dep_compute_string(miss->depend);
+					preview->problems = alpm_list_add(preview->problems,
+						new_preview_problem("missing_dependency", miss->target, depstring));
+					free(depstring);
+					alpm_depmissing_free(miss);
+				}
+				break;
+			case ALPM_ERR_CONFLICTING_DEPS:
+				for(it = data; it; it = alpm_list_next(it)) {
+					alpm_conflict_t *conflict = it->data;
+					preview->problems = alpm_list_add(preview->problems,
+						new_preview_problem("conflict", alpm_pkg_get_name(conflict->package1),
+							alpm_pkg_get_name(conflict->package2)));
+					alpm_conflict_free(conflict);
+				}
+				break;
+			case ALPM_ERR_PKG_INVALID_ARCH:
+				for(it = data; it; it = alpm_list_next(it)) {
+					preview->problems = alpm_list_add(preview->problems,
+						new_preview_problem("invalid_arch", it->data, NULL));
+					free(it->data);
+				}
+				break;
+			default:
+				preview->problems = alpm_list_add(preview->problems,
+					new_preview_problem("error", NULL, alpm_strerror(err)));
+		}
+		alpm_list_free(data);
+	} else {
+		for(it = alpm_trans_get_add(handle); it; it = alpm_list_next(it)) {
+			spkg = it->data;
+			preview->add = alpm_list_add(preview->add, new_upd_package(
+				alpm_db_get_pkg(localdb, alpm_pkg_get_name(spkg)), spkg));
+		}
+		for(it = alpm_trans_get_remove(handle); it; it = alpm_list_next(it)) {
+			preview->remove = alpm_list_add(preview->remove, new_upd_package(it->data, NULL));
+		}
+	}
+
+	alpm_trans_release(handle);
+	alpm_release(handle);
+	return preview;
+}
+
 alpm_list_t* get_group_pkgs(const char* group) {
 	alpm_list_t* it = NULL;
 	alpm_list_t* ret = NULL;
@@ -230,22 +415,97 @@ alpm_list_t* get_group_pkgs(const char* group) {
 	return ret;
 }
 
-int sync_dbs(alpm_list_t* dbs, int force){
-	alpm_list_t *it;
-	int retval = 0;
-	int tempret = 0;
-	alpm_list_t *db = NULL;
+static void free_db_sync_result(void* data) {
+	db_sync_result* result = (db_sync_result*)data;
+	free(result->name);
+	free(result->error);
+	free(result->server);
+	free(result);
+}
+
+void free_db_sync_results(alpm_list_t* results) {
+	alpm_list_free_inner(results, free_db_sync_result);
+	alpm_list_free(results);
+}
+
+/* sync_dlcb counts the bytes downloaded for the database whose
+ * result is passed as ctx. Signatures count too but only the
+ * database itself marks it as updated */
+static void sync_dlcb(void* ctx, const char* filename,
+		alpm_download_event_type_t event, void* data) {
+	db_sync_result* result = (db_sync_result*)ctx;
+	alpm_download_event_completed_t* completed = data;
+	size_t len = 0;
+	if(event != ALPM_DOWNLOAD_COMPLETED || completed->result != 0) {
+		return;
+	}
+	len = strlen(filename);
+	result->bytes += completed->total;
+	if(len < 4 || strcmp(filename + len - 4, ".sig") != 0) {
+		result->state = DB_SYNC_UPDATED;
+	}
+}
+
+static double elapsed(struct timespec* start) {
+	struct timespec end;
+	clock_gettime(CLOCK_MONOTONIC, &end);
+	return (end.tv_sec - start->tv_sec) + (end.tv_nsec - start->tv_nsec) / 1e9;
+}
+
+/* sync_dbs updates the sync databases one by one, trying their servers
+ * in order until one succeeds, and returns a db_sync_result for each.
+ * Errors that are not about a single database are returned in error */
+alpm_list_t* sync_dbs(alpm_list_t* syncdbs, int force, char** error){
+	const alpm_siglevel_t level = ALPM_SIG_DATABASE | ALPM_SIG_DATABASE_OPTIONAL;
+	alpm_list_t *it = NULL;
+	alpm_list_t *it2 = NULL;
+	alpm_list_t *ret = NULL;
+	struct timespec start;
+
 	alpm_handle_t* handle = create_handle();
-	register_sync_dbs(handle, dbs);
-	tempret = alpm_db_update(handle, dbs, force);
-	retval += abs(tempret);
-	if(tempret < 0){
-		printf("error: %s\n", alpm_strerror(alpm_errno(handle)));
-	} else {
-		printf("dbs synced successfully: %d\n", retval);
+	if(handle == NULL) {
+		*error = _strdup("could not initialize libalpm");
+		return NULL;
+	}
+	for(it = syncdbs; it; it = alpm_list_next(it)) {
+		syncdb *sdb = it->data;
+		db_sync_result* result = (db_sync_result*)calloc(1, sizeof(db_sync_result));
+		result->name = _strdup(sdb->name);
+		result->state = DB_SYNC_FAILED;
+		ret = alpm_list_add(ret, result);
+		clock_gettime(CLOCK_MONOTONIC, &start);
+		alpm_db_t *db = alpm_register_syncdb(handle, sdb->name, level);
+		if(db == NULL) {
+			result->error = _strdup(alpm_strerror(alpm_errno(handle)));
+			continue;
+		}
+		if(sdb->servers == NULL) {
+			result->error = _strdup("no servers configured");
+		}
+		alpm_list_t *dbs = alpm_list_add(NULL, db);
+		alpm_option_set_dlcb(handle, sync_dlcb, result);
+		/* a single server at a time so that the one used is known */
+		for(it2 = sdb->servers; it2; it2 = alpm_list_next(it2)) {
+			free(result->server);
+			free(result->error);
+			result->server = _strdup(it2->data);
+			result->error = NULL;
+			result->state = DB_SYNC_UP_TO_DATE;
+			alpm_db_add_server(db, it2->data);
+			int err = alpm_db_update(handle, dbs, force);
+			alpm_db_remove_server(db, it2->data);
+			if(err == 0) {
+				break;
+			}
+			result->state = DB_SYNC_FAILED;
+			result->error = _strdup(alpm_strerror(alpm_errno(handle)));
+		}
+		alpm_option_set_dlcb(handle, NULL, NULL);
+		alpm_list_free(dbs);
+		result->duration = elapsed(&start);
 	}
 	alpm_release(handle);
-	return retval;
+	return ret;
 }
 
 const char* pkgver(const char* pkgname) {
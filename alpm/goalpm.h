@@ -13,8 +13,43 @@ typedef struct upd_package {
 	char* name;
 	char* loc_version;
 	char* rem_version;
+	char* repo;
+	alpm_time_t builddate;
+	char* desc;
+	char* arch;
+	char* packager;
+	char* url;
+	alpm_list_t* groups;
+	off_t download_size;
+	off_t isize_delta;
 } upd_package;
 
+typedef struct preview_problem {
+	char* type;
+	char* package;
+	char* detail;
+} preview_problem;
+
+typedef struct preview_result {
+	alpm_list_t* add;
+	alpm_list_t* remove;
+	alpm_list_t* problems;
+} preview_result;
+
+/* states of db_sync_result */
+#define DB_SYNC_UPDATED 0
+#define DB_SYNC_UP_TO_DATE 1
+#define DB_SYNC_FAILED -1
+
+typedef struct db_sync_result {
+	char* name;
+	int state;
+	char* error;
+	char* server;
+	off_t bytes;
+	double duration;
+} db_sync_result;
+
 syncdb* new_syncdb(char*);
 void init_paths(char*, char*);
 void goalpm_cleanup();
@@ -22,11 +57,14 @@ void add_server_to_syncdb(syncdb*, char*);
 void free_syncdb_list(alpm_list_t*);
 void dump_syncdb_list(alpm_list_t*);
 void free_pkg_list(alpm_list_t*);
-int sync_dbs(alpm_list_t*, int);
+alpm_list_t* sync_dbs(alpm_list_t*, int, char**);
+void free_db_sync_results(alpm_list_t*);
 
-alpm_list_t* get_updates(alpm_list_t*);
-alpm_list_t* get_foreign(alpm_list_t*);
+alpm_list_t* get_updates(alpm_list_t*, char**);
+alpm_list_t* get_foreign(alpm_list_t*, char**);
 alpm_list_t* get_group_pkgs(const char*);
+preview_result* preview_sysupgrade(alpm_list_t*, char**);
+void free_preview(preview_result*);
 
 const char* pkgver(const char* pkgname);
 #endif
@@ -0,0 +1,300 @@
+// Package alpm provides a cgo wrapper around alpm for functions used
+// by the pkgupd server, along with a pure Go reader of the databases.
+// The wrapper is only built with cgo.
+package alpm
+
+import "regexp"
+import "os"
+import "bufio"
+import "strings"
+import "sync"
+import "fmt"
+import "errors"
+import "pkgupd/log"
+
+// Remove duplicate strings from string list
+func deduplicateStringList(a []string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, v := range a {
+		if _, ok := seen[v]; !ok {
+			result = append(result, v)
+			seen[v] = true
+		}
+	}
+	return result
+}
+
+// Pkg represents a pacman package
+type Pkg struct {
+	// Name of the package
+	Name string
+	// Local version of the package
+	LocalVersion string
+	// Remote version of the package. If there is no remote
+	// package available this should be 0
+	RemoteVersion string
+	// This is true if the package has no entry in the local
+	// database or on any remote sync database
+	Foreign bool
+	// Repository of the remote package, empty if unknown
+	Repo string
+	// Build date of the remote package as a unix timestamp,
+	// 0 if unknown
+	BuildDate int64
+	// Description of the remote package
+	Description string
+	// Architecture of the remote package
+	Arch string
+	// Size of the files that must be downloaded for the update in
+	// bytes, 0 if the package is already in the cache
+	DownloadSize int64
+	// Difference of the installed sizes of the remote and the local
+	// package in bytes
+	InstalledSizeDelta int64
+	// Packager of the remote package
+	Packager string
+	// Groups of the remote package
+	Groups []string
+	// Upstream URL of the remote package
+	URL string
+}
+
+// Problem is a reason why a system upgrade cannot be performed
+type Problem struct {
+	// One of conflict, missing_dependency, invalid_arch or error
+	Type string
+	// Package the problem was found for, empty for errors
+	Package string
+	// The conflicting package, the missing dependency or the
+	// error message
+	Detail string
+}
+
+// Preview is the outcome of a system upgrade that was prepared but
+// not performed. Either Problems is empty or Add and Remove are
+type Preview struct {
+	// Packages that would be installed or upgraded. LocalVersion
+	// is 0 for packages that are not installed yet
+	Add []*Pkg
+	// Packages that would be removed
+	Remove []*Pkg
+	// Reasons why the upgrade would fail
+	Problems []*Problem
+}
+
+// States of a DBSyncResult
+const (
+	// The database was downloaded
+	DBUpdated = "updated"
+	// The database on the server has not changed
+	DBUpToDate = "up_to_date"
+	// The database could not be synchronized from any server
+	DBFailed = "failed"
+)
+
+// DBSyncResult is the outcome of the synchronization of a sync database
+type DBSyncResult struct {
+	// Name of the database
+	Name string
+	// One of updated, up_to_date or failed
+	State string
+	// Error of the last server tried, empty unless failed
+	Error string
+	// The last server tried, empty if there is none
+	Server string
+	// Bytes downloaded, including the signature
+	Downloaded int64
+	// Duration of the synchronization in seconds
+	Duration float64
+}
+
+// DBsUpdated returns true if any of the databases was downloaded
+func DBsUpdated(results []*DBSyncResult) bool {
+	for _, r := range results {
+		if r.State == DBUpdated {
+			return true
+		}
+	}
+	return false
+}
+
+// dbSyncError returns an error listing the databases that failed to
+// synchronize or nil if none failed
+func dbSyncError(results []*DBSyncResult) error {
+	var failed []string
+	for _, r := range results {
+		if r.State == DBFailed {
+			failed = append(failed, fmt.Sprintf("%s (%s)", r.Name, r.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return errors.New("failed to synchronize " + strings.Join(failed, ", "))
+}
+
+// Backend reads and synchronizes the local and the sync databases.
+// It is implemented by Alpm, which goes through libalpm, by the pure
+// Go Reader, which does not synchronize, and by FakeBackend for
+// tests. The Locker must be held while synchronizing the databases.
+type Backend interface {
+	sync.Locker
+	// AddDatabase adds a sync database with its sync servers
+	AddDatabase(name string, servers []string) error
+	// GetUpdates returns the packages that have a newer version
+	// in a sync database, or an error if the databases could not
+	// be read
+	GetUpdates() ([]*Pkg, error)
+	// GetForeign returns the packages that are in no sync database,
+	// or an error if the databases could not be read
+	GetForeign() ([]*Pkg, error)
+	// SyncDBs synchronizes the sync databases, even those that are
+	// up to date if force is set. It returns the result of every
+	// database and an error if any of them failed
+	SyncDBs(force bool) ([]*DBSyncResult, error)
+	// GetGroupPackageNames returns the names of the installed
+	// packages of a group
+	GetGroupPackageNames(group string) []string
+	// GetIgnoredPackageNames returns the names of the packages
+	// ignored by the pacman.conf configuration
+	GetIgnoredPackageNames(conf map[string]map[string]interface{}) []string
+	// Close frees the resources of the backend once the operations
+	// holding the Locker have finished
+	Close()
+}
+
+// Previewer is implemented by the backends that can preview a system
+// upgrade. The Locker of the backend must be held during the preview.
+type Previewer interface {
+	PreviewSysupgrade() (*Preview, error)
+}
+
+// ignoredPackageNames returns a list of package names that are
+// ignored based on the parsed pacman.conf configuration. This includes
+// both IngorePkg and IgnoreGroup. IgnoreGroup packages are expanded
+// to the packages of the group known to the backend.
+func ignoredPackageNames(b Backend, conf map[string]map[string]interface{}) []string {
+	ignoredPkgs := []string{}
+	if val, ok := conf["options"]["IgnorePkg"].(string); ok {
+		for _, v := range strings.Split(val, " ") {
+			ignoredPkgs = append(ignoredPkgs, strings.Trim(v, " \t\r\n"))
+		}
+	}
+
+	if val, ok := conf["options"]["IgnoreGroup"].(string); ok {
+		var grp string
+		var grpPkgs []string
+		for _, v := range strings.Split(val, " ") {
+			grp = strings.Trim(v, " \t\r\n")
+			grpPkgs = b.GetGroupPackageNames(grp)
+			log.Debugf("Ignoring group '%s' packages %v\n", grp, grpPkgs)
+			ignoredPkgs = append(ignoredPkgs, grpPkgs...)
+		}
+	}
+	return ignoredPkgs
+}
+
+// IsUpdatable checks if this package is updatable. If
+// remote version is zero this is always false.
+func (p *Pkg) IsUpdatable() bool {
+	return IsUpdatablePkg(p)
+}
+
+// ParsePacmanConf reads the specified pacman configuration and returns a map
+// with string keys and map values. The maps are map[string]interface{}.
+// interface{} is either string or a []string
+func ParsePacmanConf(conf string) (map[string]map[string]interface{}, error) {
+	// matches "[foo]" and puts "foo" in the first match group
+	sectionRE := regexp.MustCompile(`\[(.*)\]`)
+	// matches "key = val" or just "key"; puts "key" in the first match group
+	// and "val" (if it exists) in second match group
+	stateRE := regexp.MustCompile(`(\w*)\s*=?\s*(.*)`)
+	file, err := os.Open(conf)
+	if err != nil {
+		return nil, err
+	}
+	currentSection := "options"
+	var line string
+	confMap := make(map[string]map[string]interface{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line = scanner.Text()
+		line = strings.Trim(line, " \t\r\n")
+		if strings.HasPrefix(line, "#") || len(line) == 0 {
+			continue
+		}
+		sections := sectionRE.FindStringSubmatch(line)
+		if len(sections) > 0 {
+			currentSection = sections[1]
+			if _, ok := confMap[currentSection]; !ok {
+				confMap[currentSection] = make(map[string]interface{})
+			}
+			continue
+		}
+		states := stateRE.FindStringSubmatch(line)
+		key := states[1]
+		val := states[2]
+		if len(states) > 0 {
+			if key == "Include" || key == "Server" {
+				if _, ok := confMap[currentSection][key]; !ok {
+					confMap[currentSection][key] = []string{val}
+				} else {
+					confMap[currentSection][key] =
+						append(confMap[currentSection][key].([]string), val)
+				}
+			} else {
+				confMap[currentSection][key] = val
+			}
+		}
+	}
+	file.Close()
+	return confMap, nil
+}
+
+// GetServersFromConf searches all Include and Server directives
+// found in repo section in pacman.conf and returns a list of all servers
+// that correspond to this repository. Duplicate servers are discarded.
+// The required arguments is a map of the values under the repo section (conf),
+// the name of the repo (repo) and the architecture of the machine (arch).
+// BUG: This always returns the Included servers first and the the single
+// Server directives in the section, even if they are specified in a different
+// order
+func GetServersFromConf(conf map[string]interface{}, repo string, arch string) []string {
+	var ires []string
+	if _, ok := conf["Include"]; ok {
+		var scanner *bufio.Scanner
+		var line string
+		var serverEntry []string
+		for _, entry := range conf["Include"].([]string) {
+			file, err := os.Open(entry)
+			if err != nil {
+				continue
+			}
+			scanner = bufio.NewScanner(file)
+			for scanner.Scan() {
+				line = strings.Trim(scanner.Text(), " \t\r\n")
+				if strings.HasPrefix(line, "#") || len(line) == 0 {
+					continue
+				}
+				serverEntry = strings.Split(line, "=")
+				if len(serverEntry) == 2 {
+					serverURL := strings.Trim(serverEntry[1], " \t\r\n")
+					serverURL = strings.Replace(serverURL, "$repo", repo, -1)
+					serverURL = strings.Replace(serverURL, "$arch", arch, -1)
+					ires = append(ires, serverURL)
+				}
+			}
+			file.Close()
+		}
+	}
+	if _, ok := conf["Server"]; ok {
+		for _, entry := range conf["Server"].([]string) {
+			serverURL := strings.Trim(entry, " \t\r\n")
+			serverURL = strings.Replace(serverURL, "$repo", repo, -1)
+			serverURL = strings.Replace(serverURL, "$arch", arch, -1)
+			ires = append(ires, serverURL)
+		}
+	}
+	return deduplicateStringList(ires)
+}
@@ -0,0 +1,334 @@
+package alpm
+
+import "archive/tar"
+import "bufio"
+import "compress/gzip"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "pkgupd/log"
+
+// desc holds the sections of a package desc file, keyed by the
+// section name without the enclosing percent signs
+type desc map[string][]string
+
+// ErrUnsupported is returned by the operations the reader does not
+// implement
+var ErrUnsupported = errors.New("not supported by the Go reader")
+
+// get returns the first value of the section key or an empty
+// string if there is no such section
+func (d desc) get(key string) string {
+	if v := d[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// getInt returns the first value of the section key as an integer
+// or 0 if the value is missing or not a number
+func (d desc) getInt(key string) int64 {
+	n, _ := strconv.ParseInt(d.get(key), 10, 64)
+	return n
+}
+
+// parseDesc parses a desc file of the local or a sync database.
+// Sections start with a %NAME% line followed by one value per line
+// and end with an empty line
+func parseDesc(r io.Reader) (desc, error) {
+	d := desc{}
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			section = ""
+		case section == "" && len(line) > 2 && strings.HasPrefix(line, "%") &&
+			strings.HasSuffix(line, "%"):
+			section = line[1 : len(line)-1]
+			d[section] = []string{}
+		case section != "":
+			d[section] = append(d[section], line)
+		}
+	}
+	return d, scanner.Err()
+}
+
+// syncDB is a parsed sync database along with the state of its file
+// when it was parsed
+type syncDB struct {
+	modTime time.Time
+	size    int64
+	pkgs    map[string]desc
+	// Set if the database could not be read and no earlier
+	// version was read either
+	err error
+}
+
+// Reader reads the local and the sync databases of pacman directly
+// instead of going through libalpm. Sync databases are only parsed
+// again when their file changes. A database that cannot be read keeps
+// the packages of its last readable version; as long as there is none
+// reading the updates or the foreign packages fails.
+type Reader struct {
+	// The path of the local/sync library
+	LibPath string
+	// A mutex held by the services while they work on the
+	// databases, like the mutex of Alpm
+	Mutex *sync.Mutex
+	// Names of the sync dbs in the order they were added
+	dbs []string
+	// Parsed sync dbs keyed by name
+	cache map[string]*syncDB
+	mutex *sync.Mutex
+}
+
+// NewReader returns a new database reader for the pacman local/sync
+// library in lib
+func NewReader(lib string) (*Reader, error) {
+	if _, err := os.Stat(lib); os.IsNotExist(err) {
+		return nil, fmt.Errorf("Library path '%s' does not exit", lib)
+	}
+	return &Reader{lib, &sync.Mutex{}, nil, make(map[string]*syncDB), &sync.Mutex{}}, nil
+}
+
+// AddDatabase adds the sync database named "name". The servers are
+// ignored since the reader does not synchronize the databases.
+func (r *Reader) AddDatabase(name string, servers []string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.dbs = append(r.dbs, name)
+	return nil
+}
+
+// Lock acquires the mutex of the database write operations
+func (r *Reader) Lock() {
+	r.Mutex.Lock()
+}
+
+// Unlock releases the mutex of the database write operations
+func (r *Reader) Unlock() {
+	r.Mutex.Unlock()
+}
+
+// Close waits for the operations holding the mutex to finish. The
+// reader holds no other resources
+func (r *Reader) Close() {
+	r.Mutex.Lock()
+	r.Mutex.Unlock()
+}
+
+// readLocal parses the desc files of all the installed packages
+func (r *Reader) readLocal() ([]desc, error) {
+	localPath := path.Join(r.LibPath, "local")
+	entries, err := ioutil.ReadDir(localPath)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []desc
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		file, err := os.Open(path.Join(localPath, entry.Name(), "desc"))
+		if err != nil {
+			continue
+		}
+		d, err := parseDesc(file)
+		file.Close()
+		if err != nil || d.get("NAME") == "" {
+			continue
+		}
+		pkgs = append(pkgs, d)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].get("NAME") < pkgs[j].get("NAME") })
+	return pkgs, nil
+}
+
+// readSyncDB parses the package entries of a sync database file. Only
+// uncompressed and gzip compressed databases are supported
+func readSyncDB(file io.Reader) (map[string]desc, error) {
+	br := bufio.NewReader(file)
+	var tr *tar.Reader
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		tr = tar.NewReader(gr)
+	} else {
+		tr = tar.NewReader(br)
+	}
+	pkgs := make(map[string]desc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Base(hdr.Name) != "desc" {
+			continue
+		}
+		d, err := parseDesc(tr)
+		if err != nil {
+			return nil, err
+		}
+		if name := d.get("NAME"); name != "" {
+			pkgs[name] = d
+		}
+	}
+	return pkgs, nil
+}
+
+// syncDBs returns the parsed sync databases in the order they were
+// added. Databases that have not been synchronized yet are empty.
+// An error is returned if a database has never been read successfully
+func (r *Reader) syncDBs() ([]*syncDB, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var ret []*syncDB
+	var dbErr error
+	for _, name := range r.dbs {
+		dbPath := path.Join(r.LibPath, "sync", name+".db")
+		fi, err := os.Stat(dbPath)
+		if err != nil {
+			ret = append(ret, &syncDB{})
+			continue
+		}
+		db, ok := r.cache[name]
+		if !ok || !db.modTime.Equal(fi.ModTime()) || db.size != fi.Size() {
+			db = r.loadSyncDB(name, dbPath, fi)
+		}
+		if db.err != nil && dbErr == nil {
+			dbErr = fmt.Errorf("sync database %s: %s", name, db.err)
+		}
+		ret = append(ret, db)
+	}
+	return ret, dbErr
+}
+
+// loadSyncDB parses the sync database name again and caches it. If it
+// cannot be read the packages of the cached version are kept. The
+// caller must hold the mutex
+func (r *Reader) loadSyncDB(name string, dbPath string, fi os.FileInfo) *syncDB {
+	db := &syncDB{fi.ModTime(), fi.Size(), nil, nil}
+	file, err := os.Open(dbPath)
+	if err == nil {
+		db.pkgs, err = readSyncDB(file)
+		file.Close()
+	}
+	if err != nil {
+		log.Warnf("Could not read sync database %s: %s\n", name, err)
+		if old, ok := r.cache[name]; ok && old.err == nil {
+			db.pkgs = old.pkgs
+		} else {
+			db.err = err
+		}
+	}
+	r.cache[name] = db
+	return db
+}
+
+// GetUpdates returns a slice of package ([]*Pkg) that are updatable.
+// Only local packages with remote versions in a repo are included.
+// Like libalpm the first sync database that has the package decides
+// its remote version. An error is returned if the local database or
+// a sync database without an earlier readable version cannot be read.
+func (r *Reader) GetUpdates() ([]*Pkg, error) {
+	var pkglist []*Pkg
+	local, err := r.readLocal()
+	if err != nil {
+		return nil, fmt.Errorf("local database: %s", err)
+	}
+	dbs, err := r.syncDBs()
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range local {
+		for i, db := range dbs {
+			spkg, ok := db.pkgs[pkg.get("NAME")]
+			if !ok {
+				continue
+			}
+			if VerCmp(spkg.get("VERSION"), pkg.get("VERSION")) > 0 {
+				pkglist = append(pkglist, &Pkg{pkg.get("NAME"), pkg.get("VERSION"),
+					spkg.get("VERSION"), false, r.dbs[i], spkg.getInt("BUILDDATE"),
+					spkg.get("DESC"), spkg.get("ARCH"), spkg.getInt("CSIZE"),
+					spkg.getInt("ISIZE") - pkg.getInt("SIZE"), spkg.get("PACKAGER"),
+					spkg["GROUPS"], spkg.get("URL")})
+			}
+			break
+		}
+	}
+	return pkglist, nil
+}
+
+// GetForeign returns a slice of all foreign packages ([]*Pkg). It
+// fails like GetUpdates.
+func (r *Reader) GetForeign() ([]*Pkg, error) {
+	var pkglist []*Pkg
+	local, err := r.readLocal()
+	if err != nil {
+		return nil, fmt.Errorf("local database: %s", err)
+	}
+	dbs, err := r.syncDBs()
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range local {
+		foreign := true
+		for _, db := range dbs {
+			if _, ok := db.pkgs[pkg.get("NAME")]; ok {
+				foreign = false
+				break
+			}
+		}
+		if foreign {
+			pkglist = append(pkglist, &Pkg{Name: pkg.get("NAME"),
+				LocalVersion: pkg.get("VERSION"), RemoteVersion: "0", Foreign: true})
+		}
+	}
+	return pkglist, nil
+}
+
+// GetGroupPackageNames returns a slice of string including all the
+// package names that fall under the specified group.
+func (r *Reader) GetGroupPackageNames(group string) []string {
+	ret := []string{}
+	local, _ := r.readLocal()
+	for _, pkg := range local {
+		for _, g := range pkg["GROUPS"] {
+			if g == group {
+				ret = append(ret, pkg.get("NAME"))
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// GetIgnoredPackageNames returns a list of package names that are
+// ignored based on the parsed pacman.conf configuration. This includes
+// both IngorePkg and IgnoreGroup. IgnoreGroup packages are expanded to
+// the included packages.
+func (r *Reader) GetIgnoredPackageNames(conf map[string]map[string]interface{}) []string {
+	return ignoredPackageNames(r, conf)
+}
+
+// SyncDBs is not supported by the reader, the databases are
+// synchronized with libalpm
+func (r *Reader) SyncDBs(force bool) ([]*DBSyncResult, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,186 @@
+package alpm
+
+import "archive/tar"
+import "bytes"
+import "compress/gzip"
+import "io/ioutil"
+import "os"
+import "path"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+// writeDesc writes a local desc file in the library lib
+func writeDesc(t *testing.T, lib string, name string, version string, size string) {
+	dir := path.Join(lib, "local", name+"-"+version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	desc := "%NAME%\n" + name + "\n\n%VERSION%\n" + version + "\n\n%SIZE%\n" + size + "\n\n"
+	if err := ioutil.WriteFile(path.Join(dir, "desc"), []byte(desc), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeSyncDB writes a gzip compressed sync database with the desc
+// files in entries, keyed by the package directory
+func writeSyncDB(t *testing.T, lib string, name string, entries map[string]string) {
+	os.MkdirAll(path.Join(lib, "sync"), 0755)
+	file, err := os.Create(path.Join(lib, "sync", name+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gw := gzip.NewWriter(file)
+	tw := tar.NewWriter(gw)
+	for dir, desc := range entries {
+		tw.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755})
+		tw.WriteHeader(&tar.Header{Name: dir + "/desc", Typeflag: tar.TypeReg,
+			Mode: 0644, Size: int64(len(desc))})
+		tw.Write([]byte(desc))
+	}
+	tw.Close()
+	gw.Close()
+}
+
+func TestParseDesc(t *testing.T) {
+	d, err := parseDesc(strings.NewReader("%NAME%\nlinux\n\n%GROUPS%\nbase\nkernel\n\n%CSIZE%\n1024\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.get("NAME") != "linux" || d.getInt("CSIZE") != 1024 || d.get("URL") != "" {
+		t.Errorf("unexpected desc %v", d)
+	}
+	if !reflect.DeepEqual(d["GROUPS"], []string{"base", "kernel"}) {
+		t.Errorf("unexpected groups %v", d["GROUPS"])
+	}
+}
+
+func TestReader(t *testing.T) {
+	lib, err := ioutil.TempDir("", "pkgupd-reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(lib)
+	writeDesc(t, lib, "linux", "4.7.1-1", "1000")
+	writeDesc(t, lib, "bash", "4.3.046-1", "500")
+	writeDesc(t, lib, "firefox", "48.0-1", "2000")
+	writeDesc(t, lib, "yaourt", "1.8.1-1", "10")
+	writeSyncDB(t, lib, "core", map[string]string{
+		"linux-4.7.2-1": "%NAME%\nlinux\n\n%VERSION%\n4.7.2-1\n\n%DESC%\nThe Linux kernel\n\n" +
+			"%GROUPS%\nbase\n\n%CSIZE%\n300\n\n%ISIZE%\n1500\n\n%ARCH%\nx86_64\n\n" +
+			"%BUILDDATE%\n100\n\n%PACKAGER%\nPackager <p@example.org>\n\n%URL%\nhttp://kernel.org\n\n",
+		"bash-4.3.046-1": "%NAME%\nbash\n\n%VERSION%\n4.3.046-1\n\n",
+	})
+	writeSyncDB(t, lib, "extra", map[string]string{
+		"linux-4.8-1":    "%NAME%\nlinux\n\n%VERSION%\n4.8-1\n\n",
+		"firefox-49.0-1": "%NAME%\nfirefox\n\n%VERSION%\n49.0-1\n\n",
+	})
+
+	reader, err := NewReader(lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.AddDatabase("core", nil)
+	reader.AddDatabase("extra", nil)
+	reader.AddDatabase("community", nil)
+
+	expected := []*Pkg{
+		{Name: "firefox", LocalVersion: "48.0-1", RemoteVersion: "49.0-1", Repo: "extra",
+			InstalledSizeDelta: -2000},
+		{"linux", "4.7.1-1", "4.7.2-1", false, "core", 100, "The Linux kernel", "x86_64",
+			300, 500, "Packager <p@example.org>", []string{"base"}, "http://kernel.org"},
+	}
+	if pkgs, err := reader.GetUpdates(); err != nil || !reflect.DeepEqual(pkgs, expected) {
+		t.Errorf("expected updates %v, got %v, %v", expected, pkgs, err)
+	}
+	foreign := []*Pkg{{Name: "yaourt", LocalVersion: "1.8.1-1", RemoteVersion: "0", Foreign: true}}
+	if pkgs, err := reader.GetForeign(); err != nil || !reflect.DeepEqual(pkgs, foreign) {
+		t.Errorf("expected foreign packages %v, got %v, %v", foreign, pkgs, err)
+	}
+
+	// a changed database is read again
+	writeSyncDB(t, lib, "core", map[string]string{
+		"bash-4.4-1": "%NAME%\nbash\n\n%VERSION%\n4.4-1\n\n",
+	})
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path.Join(lib, "sync", "core.db"), future, future)
+	var names []string
+	pkgs, _ := reader.GetUpdates()
+	for _, pkg := range pkgs {
+		names = append(names, pkg.Name+" "+pkg.RemoteVersion)
+	}
+	if !reflect.DeepEqual(names, []string{"bash 4.4-1", "firefox 49.0-1", "linux 4.8-1"}) {
+		t.Errorf("unexpected updates after the sync: %v", names)
+	}
+	if _, err := reader.SyncDBs(false); err != ErrUnsupported {
+		t.Errorf("expected syncs to be unsupported, got %v", err)
+	}
+}
+
+func TestReaderUnreadableDB(t *testing.T) {
+	lib, err := ioutil.TempDir("", "pkgupd-reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(lib)
+	writeDesc(t, lib, "linux", "4.7.1-1", "1000")
+	writeDesc(t, lib, "yaourt", "1.8.1-1", "10")
+	writeSyncDB(t, lib, "core", map[string]string{
+		"linux-4.7.2-1": "%NAME%\nlinux\n\n%VERSION%\n4.7.2-1\n\n",
+	})
+	reader, err := NewReader(lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.AddDatabase("core", nil)
+	if pkgs, err := reader.GetUpdates(); err != nil || len(pkgs) != 1 {
+		t.Fatalf("expected an update of linux, got %v, %v", pkgs, err)
+	}
+
+	// a database the reader does not understand, like a zstd
+	// compressed one, keeps the packages read before
+	zstd := bytes.Repeat([]byte{0x28, 0xb5, 0x2f, 0xfd}, 256)
+	dbPath := path.Join(lib, "sync", "core.db")
+	if err = ioutil.WriteFile(dbPath, zstd, 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(dbPath, future, future)
+	if pkgs, err := reader.GetUpdates(); err != nil || len(pkgs) != 1 ||
+		pkgs[0].RemoteVersion != "4.7.2-1" {
+		t.Errorf("expected the update read before, got %v, %v", pkgs, err)
+	}
+	if pkgs, err := reader.GetForeign(); err != nil || len(pkgs) != 1 || pkgs[0].Name != "yaourt" {
+		t.Errorf("expected only yaourt to be foreign, got %v, %v", pkgs, err)
+	}
+
+	// without an earlier version reading the packages fails
+	reader, err = NewReader(lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.AddDatabase("core", nil)
+	if pkgs, err := reader.GetForeign(); err == nil || !strings.Contains(err.Error(), "core") {
+		t.Errorf("expected an error for core, got %v, %v", pkgs, err)
+	}
+	if pkgs, err := reader.GetUpdates(); err == nil {
+		t.Errorf("expected an error, got %v", pkgs)
+	}
+
+	// so does a missing local database
+	if err = os.RemoveAll(path.Join(lib, "local")); err != nil {
+		t.Fatal(err)
+	}
+	writeSyncDB(t, lib, "core", map[string]string{
+		"linux-4.7.2-1": "%NAME%\nlinux\n\n%VERSION%\n4.7.2-1\n\n",
+	})
+	os.Chtimes(dbPath, future, future)
+	if pkgs, err := reader.GetUpdates(); err == nil || !strings.Contains(err.Error(), "local") {
+		t.Errorf("expected an error for the local database, got %v, %v", pkgs, err)
+	}
+	if pkgs, err := reader.GetForeign(); err == nil {
+		t.Errorf("expected an error, got %v", pkgs)
+	}
+}
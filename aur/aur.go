@@ -105,8 +105,10 @@ func InfoPkg(pkg *alpm.Pkg) (*Pkg, error) {
 
 // UpdateRemoteVersions will populate the RemoteVersion field of
 // all the provided alpm.Pkg structs with their AUR version if
-// available. If a server error is encountered the returned
-// error contains the server's respose
+// available. Repo is set to aur, BuildDate to the time of the last
+// modification of the AUR package and Description and URL to those
+// of the AUR package. If a server error is
+// encountered the returned error contains the server's respose
 func UpdateRemoteVersions(fpkgs []*alpm.Pkg) error {
 	// Morph packages into map for easy indexing
 	pkgs := make(map[string]*alpm.Pkg)
@@ -145,6 +147,10 @@ func UpdateRemoteVersions(fpkgs []*alpm.Pkg) error {
 	for _, item := range aurPkgList {
 		remVersion = item.Version
 		pkgs[item.Name].RemoteVersion = remVersion
+		pkgs[item.Name].Repo = "aur"
+		pkgs[item.Name].BuildDate = int64(item.LastModified)
+		pkgs[item.Name].Description = item.Description
+		pkgs[item.Name].URL = item.Type
 	}
 
 	return nil
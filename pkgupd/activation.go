@@ -0,0 +1,82 @@
+package main
+
+import "net"
+import "os"
+import "strconv"
+import "strings"
+import "syscall"
+import "fmt"
+import "pkgupd/log"
+
+// First file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// Name of the activated socket that serves the HTTP API. All other
+// activated sockets serve the socket protocol.
+const APIFdName = "http"
+
+// activatedListener is a socket passed by systemd socket activation
+// along with its FileDescriptorName
+type activatedListener struct {
+	Name     string
+	Listener deadliningListener
+}
+
+// activationListeners returns the listeners passed by systemd socket
+// activation (LISTEN_PID/LISTEN_FDS) in the order they were passed.
+// systemd names all sockets of a unit after the unit unless they have
+// a FileDescriptorName, so names are not unique. Unnamed sockets get
+// the name "unknown" suffixed by their index. If the process was not
+// socket activated the slice is empty.
+func activationListeners() ([]*activatedListener, error) {
+	return listenersFromFds(listenFdsStart)
+}
+
+// listenersFromFds returns the activated listeners, the first of which
+// has the file descriptor first. If a socket cannot be used the
+// listeners already created are closed.
+func listenersFromFds(first int) ([]*activatedListener, error) {
+	var listeners []*activatedListener
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return listeners, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Do not pass the sockets to children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	fail := func(err error) ([]*activatedListener, error) {
+		for _, l := range listeners {
+			l.Listener.Close()
+		}
+		return nil, err
+	}
+	for i := 0; i < nfds; i++ {
+		fd := first + i
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("unknown%d", i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fail(fmt.Errorf("activated socket %s: %s", name, err))
+		}
+		dl, ok := l.(deadliningListener)
+		if !ok {
+			l.Close()
+			return fail(fmt.Errorf("activated socket %s is not a stream socket", name))
+		}
+		log.Infof("Using activated socket %s (%s)\n", name, l.Addr())
+		listeners = append(listeners, &activatedListener{name, dl})
+	}
+	return listeners, nil
+}
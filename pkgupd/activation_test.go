@@ -0,0 +1,56 @@
+package main
+
+import "io/ioutil"
+import "net"
+import "os"
+import "path"
+import "strconv"
+import "syscall"
+import "testing"
+
+func TestActivationListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgupd-activation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// two sockets of the same unit get the same name and are
+	// passed on consecutive descriptors starting at first
+	const first = 100
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("unix", path.Join(dir, "s"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := l.(*net.UnixListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = syscall.Dup3(int(f.Fd()), first+i, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		l.Close()
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	os.Setenv("LISTEN_FDNAMES", "pkgupd:pkgupd")
+
+	listeners, err := listenersFromFds(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("expected both sockets, got %d", len(listeners))
+	}
+	for i, l := range listeners {
+		if l.Name != "pkgupd" || l.Listener.Addr().String() != path.Join(dir, "s"+strconv.Itoa(i)) {
+			t.Errorf("unexpected listener %s %s", l.Name, l.Listener.Addr())
+		}
+		l.Listener.Close()
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("the activation variables should be cleared")
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import "bufio"
+import "net"
+import "fmt"
+import "sync"
+import "time"
+import "context"
+import "crypto/tls"
+import "net/http"
+import "net/url"
+import "encoding/json"
+import "strconv"
+import "strings"
+import "pkgupd/log"
+
+// Prefix of all HTTP API endpoints
+const APIPrefix = "/v1/"
+
+// ServeAPI starts serving the HTTP/JSON API to the configured address.
+// The API is backed by the same services as Server.Serve and responses
+// use the same format as the socket protocol. Requests are restricted
+// by the policy; a nil policy allows all requests
+func (s *Server) ServeAPI(proto string, addr string, policy *ListenerPolicy) {
+	listener, err := s.createListener(proto, addr)
+	if err != nil {
+		log.Errorln("Failed to create HTTP listener:", err)
+		s.serverError <- true
+		return
+	}
+	s.ServeAPIListener(listener, policy)
+}
+
+// ServeAPIListener starts serving the HTTP/JSON API on an already
+// open listener
+func (s *Server) ServeAPIListener(listener net.Listener, policy *ListenerPolicy) {
+	s.waitGroup.Add(1)
+	defer s.waitGroup.Done()
+	handler := withListenerPolicy(s.apiHandler(), policy)
+	if s.authRequired(listener.Addr()) {
+		handler = s.requireBearer(handler)
+	}
+	if s.tlsConfig != nil && listener.Addr().Network() == "tcp" {
+		log.Infoln("Enabling TLS for HTTP API", listener.Addr())
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	listener = &limitListener{listener, s}
+	srv := &http.Server{Handler: handler, ConnContext: peerCredContext,
+		ReadHeaderTimeout: s.idleTimeout, IdleTimeout: s.idleTimeout}
+	// Requests in progress get the grace period to finish
+	done := make(chan bool)
+	go func() {
+		<-s.closeMsg
+		ctx, cancel := context.WithTimeout(context.Background(), s.gracePeriod)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warnln("Grace period expired, closing HTTP API connections")
+			srv.Close()
+		}
+		cancel()
+		close(done)
+	}()
+	if err := srv.Serve(listener); err != http.ErrServerClosed {
+		log.Errorln("HTTP API stopped:", err)
+		return
+	}
+	<-done
+}
+
+// limitListener counts the connections of the HTTP API against the
+// connection limit of the server
+type limitListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.server.acquireConn(conn) {
+			return &limitConn{conn, l.server, &sync.Once{}}, nil
+		}
+		log.Warnf("Too many connections, rejecting %s\n", conn.RemoteAddr())
+		go rejectAPIConn(conn)
+	}
+}
+
+// limitConn frees its connection slot when it is closed
+type limitConn struct {
+	net.Conn
+	server  *Server
+	release *sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.release.Do(func() { c.server.releaseConn(c.Conn) })
+	return err
+}
+
+// rejectAPIConn answers a connection over the limit with an error
+// of code too_many_connections and closes it. The request header is
+// read first so that the client does not lose the answer while it is
+// still writing the request
+func rejectAPIConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(WriteTimeout))
+	http.ReadRequest(bufio.NewReader(conn))
+	body, err := json.Marshal(newErrorResponse(ProtocolVersion,
+		ErrTooManyConnections, "too many connections"))
+	if err != nil {
+		log.Errorln("Could not marshal json:", err)
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	fmt.Fprintf(conn, "HTTP/1.1 503 Service Unavailable\r\n"+
+		"Content-Type: application/json\r\nContent-Length: %d\r\n"+
+		"Connection: close\r\n\r\n%s\n", len(body)+1, body)
+}
+
+func (s *Server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(APIPrefix+"updates/", s.apiUpdates)
+	mux.HandleFunc(APIPrefix+"sync", s.apiSync)
+	mux.HandleFunc(APIPrefix+"jobs/", s.apiJobs)
+	mux.HandleFunc(APIPrefix+"changes", s.apiChanges)
+	mux.HandleFunc(APIPrefix+"events", s.apiEvents)
+	mux.HandleFunc(APIPrefix+"ws", s.apiWebSocket)
+	mux.HandleFunc(APIPrefix+"status", s.apiStatus)
+	mux.HandleFunc(APIPrefix+"stats", s.apiStats)
+	mux.HandleFunc(APIPrefix+"capabilities", s.apiCapabilities)
+	mux.HandleFunc(APIPrefix+"schema", s.apiSchema)
+	return mux
+}
+
+// writeAPIResponse writes the response as json with the specified
+// http status code
+func writeAPIResponse(w http.ResponseWriter, code int, resp *Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	respString, err := json.Marshal(resp)
+	if err != nil {
+		log.Errorln("Could not marshal json:", err)
+		return
+	}
+	w.Write(append(respString, '\n'))
+}
+
+type listenerPolicyKey struct{}
+
+// withListenerPolicy wraps an HTTP handler and stores the policy of
+// the listener in the request context
+func withListenerPolicy(handler http.Handler, policy *ListenerPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), listenerPolicyKey{}, policy)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// apiAllowed checks the listener policy and, for requests over unix
+// sockets, the peer policy. If the request type is not allowed the
+// error response is written and false is returned
+func (s *Server) apiAllowed(w http.ResponseWriter, r *http.Request, version int,
+	requestType string) bool {
+	if s.apiClient(r).allows(requestType) {
+		return true
+	}
+	writeAPIResponse(w, http.StatusForbidden, newErrorResponse(version, ErrForbidden,
+		"request "+requestType+" is not allowed"))
+	return false
+}
+
+// apiClient returns a client with the listener policy and the peer
+// credentials of the request so that the services of a response are
+// checked one by one
+func (s *Server) apiClient(r *http.Request) *client {
+	policy, _ := r.Context().Value(listenerPolicyKey{}).(*ListenerPolicy)
+	return &client{policy: policy, cred: httpPeerCred(r), peerPolicy: s.peerPolicy}
+}
+
+// apiVersion negotiates the protocol version pinned with the version
+// query parameter. On failure the error response is written and false
+// is returned
+func apiVersion(w http.ResponseWriter, r *http.Request, method string) (int, bool) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAPIResponse(w, http.StatusMethodNotAllowed,
+			newErrorResponse(ProtocolVersion, ErrInvalidRequest, "method not allowed"))
+		return 0, false
+	}
+	pinned := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		if pinned, err = strconv.Atoi(v); err != nil {
+			writeAPIResponse(w, http.StatusBadRequest,
+				newErrorResponse(ProtocolVersion, ErrUnsupportedVersion, "invalid version "+v))
+			return 0, false
+		}
+	}
+	version, err := negotiateVersion(pinned)
+	if err != nil {
+		writeAPIResponse(w, http.StatusBadRequest,
+			newErrorResponse(ProtocolVersion, ErrUnsupportedVersion, err.Error()))
+		return 0, false
+	}
+	return version, true
+}
+
+// apiFilter builds a package filter from the name, regex, repo,
+// foreign, newer_than, sort and fields query parameters. Lists are
+// comma separated or repeated. If no parameter is set the filter
+// is nil
+func apiFilter(q url.Values) (*PkgFilter, error) {
+	f := &PkgFilter{Name: q.Get("name"), Regex: q.Get("regex"),
+		Repos: splitList(q["repo"]), Sort: q.Get("sort"),
+		Fields: splitList(q["fields"])}
+	if v := q.Get("foreign"); v != "" && v != "0" && v != "false" {
+		f.Foreign = true
+	}
+	if v := q.Get("newer_than"); v != "" {
+		t, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		f.NewerThan = t
+	}
+	if f.Name == "" && f.Regex == "" && len(f.Repos) == 0 && !f.Foreign &&
+		f.NewerThan == 0 && f.Sort == "" && len(f.Fields) == 0 {
+		return nil, nil
+	}
+	return f, f.compile()
+}
+
+// apiUpdates answers GET /v1/updates/{service}
+func (s *Server) apiUpdates(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "GET")
+	if !ok {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, APIPrefix+"updates/")
+	if !s.apiAllowed(w, r, version, key) {
+		return
+	}
+	filter, ferr := apiFilter(r.URL.Query())
+	if ferr != nil {
+		writeAPIResponse(w, http.StatusBadRequest,
+			newErrorResponse(version, ErrInvalidFilter, ferr.Error()))
+		return
+	}
+	data, warnings, err := s.serviceData(key)
+	if err != nil {
+		code := http.StatusServiceUnavailable
+		if err.Code == ErrUnknownService {
+			code = http.StatusNotFound
+		}
+		writeAPIResponse(w, code, newErrorResponse(version, err.Code, err.Message))
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, newResponse(version, filter.apply(data), warnings...))
+}
+
+// apiSync answers POST /v1/sync
+func (s *Server) apiSync(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "POST")
+	if !ok {
+		return
+	}
+	if !s.apiAllowed(w, r, version, "sync") {
+		return
+	}
+	if _, ok := s.services["sync"]; !ok {
+		writeAPIResponse(w, http.StatusNotFound,
+			newErrorResponse(version, ErrUnknownService, "sync service is not enabled"))
+		return
+	}
+	wait := r.URL.Query().Get("wait")
+	resp := s.serviceRequest(s.apiClient(r), &Request{RequestType: "sync",
+		Wait: wait != "" && wait != "0" && wait != "false"}, version)
+	writeAPIResponse(w, http.StatusOK, resp)
+}
+
+// apiJobs answers GET /v1/jobs/{id}
+func (s *Server) apiJobs(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "GET")
+	if !ok {
+		return
+	}
+	if !s.apiAllowed(w, r, version, "job_status") {
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, APIPrefix+"jobs/"))
+	if err != nil {
+		writeAPIResponse(w, http.StatusBadRequest,
+			newErrorResponse(version, ErrInvalidRequest, "invalid job id"))
+		return
+	}
+	resp := s.jobStatusRequest(nil, &Request{RequestType: "job_status", Job: id}, version)
+	code := http.StatusOK
+	if resp.ResponseType == "error" {
+		code = http.StatusNotFound
+	}
+	writeAPIResponse(w, code, resp)
+}
+
+// apiChanges answers GET /v1/changes?since={token}&service={service}
+func (s *Server) apiChanges(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "GET")
+	if !ok {
+		return
+	}
+	if !s.apiAllowed(w, r, version, "changes") {
+		return
+	}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeAPIResponse(w, http.StatusBadRequest,
+				newErrorResponse(version, ErrInvalidRequest, "invalid token "+v))
+			return
+		}
+	}
+	req := &Request{RequestType: "changes", Since: since,
+		Services: splitList(r.URL.Query()["service"])}
+	writeAPIResponse(w, http.StatusOK, s.changesRequest(s.apiClient(r), req, version))
+}
+
+// apiStatus answers GET /v1/status
+func (s *Server) apiStatus(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "GET")
+	if !ok {
+		return
+	}
+	if !s.apiAllowed(w, r, version, "status") {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, s.statusRequest(nil, &Request{}, version))
+}
+
+// apiStats answers GET /v1/stats
+func (s *Server) apiStats(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "GET")
+	if !ok {
+		return
+	}
+	if !s.apiAllowed(w, r, version, "stats") {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, s.statsRequest(nil, &Request{}, version))
+}
+
+// apiCapabilities answers GET /v1/capabilities
+func (s *Server) apiCapabilities(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "GET")
+	if !ok {
+		return
+	}
+	if !s.apiAllowed(w, r, version, "capabilities") {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, s.helloRequest(nil, &Request{}, version))
+}
+
+// apiSchema answers GET /v1/schema
+func (s *Server) apiSchema(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "GET")
+	if !ok {
+		return
+	}
+	if !s.apiAllowed(w, r, version, "schema") {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, s.schemaRequest(nil, &Request{}, version))
+}
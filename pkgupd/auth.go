@@ -0,0 +1,109 @@
+package main
+
+import "crypto/subtle"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "strings"
+
+// Request types that can be served without an authentication token
+var unauthenticatedRequestTypes = []string{"hello", "capabilities"}
+
+// tlsListener wraps a listener and serves TLS on every accepted
+// connection. The handshake happens on the first read or write.
+type tlsListener struct {
+	deadliningListener
+	config *tls.Config
+}
+
+// Accept waits for the next connection and wraps it in a TLS
+// server connection
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.deadliningListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.config), nil
+}
+
+// EnableTLS enables TLS on all TCP listeners created afterwards using
+// the specified certificate and key. If clientCA is not empty clients
+// must present a certificate signed by one of the CAs in that file.
+func (s *Server) EnableTLS(cert string, key string, clientCA string) error {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{pair},
+		MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.tlsConfig = config
+	return nil
+}
+
+// SetAuthToken sets the token that clients connecting over TCP must
+// send with every request. The token is read from the first line of
+// the specified file.
+func (s *Server) SetAuthToken(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+	if token == "" {
+		return errors.New("empty token in " + path)
+	}
+	s.authToken = token
+	return nil
+}
+
+// authRequired returns true if connections accepted on a listener
+// with the specified local address must authenticate
+func (s *Server) authRequired(addr net.Addr) bool {
+	return s.authToken != "" && addr.Network() == "tcp"
+}
+
+// validToken compares the token with the server token in
+// constant time
+func (s *Server) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.authToken)) == 1
+}
+
+// authenticate checks the token of a request from a client that must
+// authenticate. Requests that do not need a token always succeed.
+func (s *Server) authenticate(req *Request) bool {
+	if stringInList(unauthenticatedRequestTypes, req.RequestType) {
+		return true
+	}
+	return s.validToken(req.Token)
+}
+
+// requireBearer wraps an HTTP handler and rejects requests that do not
+// carry the server token as bearer token
+func (s *Server) requireBearer(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			!s.validToken(strings.TrimPrefix(auth, "Bearer ")) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIResponse(w, http.StatusUnauthorized,
+				newErrorResponse(ProtocolVersion, ErrUnauthorized, "unauthorized"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
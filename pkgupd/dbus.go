@@ -0,0 +1,241 @@
+package main
+
+import "fmt"
+import "os/user"
+import "strconv"
+import "strings"
+import "time"
+import "pkgupd/alpm"
+import "pkgupd/log"
+import "github.com/godbus/dbus"
+import "github.com/godbus/dbus/introspect"
+
+// Well-known name, object path and interface of the daemon on D-Bus
+const (
+	DBusName      = "com.github.foucault.Pkgupd"
+	DBusPath      = "/com/github/foucault/Pkgupd"
+	DBusInterface = "com.github.foucault.Pkgupd"
+)
+
+// dbusPkg is the D-Bus representation of a package,
+// (sssbsxssxxsass)
+type dbusPkg struct {
+	Name               string
+	LocalVersion       string
+	RemoteVersion      string
+	Foreign            bool
+	Repo               string
+	BuildDate          int64
+	Description        string
+	Arch               string
+	DownloadSize       int64
+	InstalledSizeDelta int64
+	Packager           string
+	Groups             []string
+	URL                string
+}
+
+// dbusStatus is the D-Bus representation of a ServiceStatus,
+// (xxxdsxb). Times are unix timestamps, 0 if the event has not
+// happened yet
+type dbusStatus struct {
+	LastStart   int64
+	LastEnd     int64
+	LastSuccess int64
+	Duration    float64
+	LastError   string
+	NextRun     int64
+	Running     bool
+}
+
+// dbusService exports the server on D-Bus. Its exported methods
+// mirror the requests of the socket protocol and it emits the
+// UpdatesChanged signal when the results of a service change
+type dbusService struct {
+	server *Server
+	conn   *dbus.Conn
+}
+
+// dbusIntrospection describes the exported interface; the methods
+// are filled in by export
+var dbusIntrospection = introspect.Interface{
+	Name: DBusInterface,
+	Signals: []introspect.Signal{
+		{Name: "UpdatesChanged", Args: []introspect.Arg{
+			{Name: "service", Type: "s"},
+			{Name: "token", Type: "t"},
+		}},
+	},
+}
+
+// connectDBus opens a private connection to the bus at address or
+// to the system bus if address is empty
+func connectDBus(address string) (*dbus.Conn, error) {
+	var conn *dbus.Conn
+	var err error
+	if address == "" {
+		conn, err = dbus.SystemBusPrivate()
+	} else {
+		conn, err = dbus.Dial(address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ServeDBus exports the server on the bus at address, or on the
+// system bus if address is empty, until the server is stopped
+func (s *Server) ServeDBus(address string) {
+	s.waitGroup.Add(1)
+	defer s.waitGroup.Done()
+	conn, err := connectDBus(address)
+	if err != nil {
+		log.Errorln("Could not connect to D-Bus:", err)
+		s.serverError <- true
+		return
+	}
+	defer conn.Close()
+	d := &dbusService{s, conn}
+	s.AddListener(d)
+	if err = d.export(); err != nil {
+		log.Errorln("Could not export D-Bus interface:", err)
+		s.serverError <- true
+		return
+	}
+	log.Infoln("Serving on D-Bus as", DBusName)
+	<-s.closeMsg
+	conn.ReleaseName(DBusName)
+}
+
+// export exports the object and its introspection data and claims
+// the well-known name
+func (d *dbusService) export() error {
+	if err := d.conn.Export(d, DBusPath, DBusInterface); err != nil {
+		return err
+	}
+	iface := dbusIntrospection
+	iface.Methods = introspect.Methods(d)
+	node := &introspect.Node{Name: DBusPath,
+		Interfaces: []introspect.Interface{introspect.IntrospectData, iface}}
+	err := d.conn.Export(introspect.NewIntrospectable(node), DBusPath,
+		"org.freedesktop.DBus.Introspectable")
+	if err != nil {
+		return err
+	}
+	reply, err := d.conn.RequestName(DBusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("name %s is already taken", DBusName)
+	}
+	return nil
+}
+
+// ProcessEvent implements the Listener interface and emits the
+// UpdatesChanged signal. It is not exported on D-Bus
+func (d *dbusService) ProcessEvent(msg string) {
+	tmsg := strings.Split(msg, ";;")
+	if tmsg[0] != "updates_changed" || len(tmsg) != 3 {
+		return
+	}
+	token, _ := strconv.ParseUint(tmsg[2], 10, 64)
+	err := d.conn.Emit(DBusPath, DBusInterface+".UpdatesChanged", tmsg[1], token)
+	if err != nil {
+		log.Warnln("Could not emit D-Bus signal:", err)
+	}
+}
+
+// dbusError converts a protocol error code to a D-Bus error
+func dbusError(code string, msg string) *dbus.Error {
+	return dbus.NewError(DBusInterface+".Error."+code, []interface{}{msg})
+}
+
+// allows checks the peer policy for the sender of a method call
+func (d *dbusService) allows(sender dbus.Sender, requestType string) *dbus.Error {
+	cred := &peerCred{uid: ^uint32(0)}
+	var uid uint32
+	err := d.conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixUser",
+		0, string(sender)).Store(&uid)
+	if err == nil {
+		gid := ^uint32(0)
+		if u, err := user.LookupId(strconv.Itoa(int(uid))); err == nil {
+			if g, err := strconv.ParseUint(u.Gid, 10, 32); err == nil {
+				gid = uint32(g)
+			}
+		}
+		cred = newPeerCred(uid, gid)
+	}
+	if !d.server.peerPolicy.Allows(requestType, cred) {
+		return dbusError(ErrForbidden, "request "+requestType+" is not allowed")
+	}
+	return nil
+}
+
+// GetUpdates returns the updates of a service
+func (d *dbusService) GetUpdates(sender dbus.Sender, service string) ([]dbusPkg, *dbus.Error) {
+	if derr := d.allows(sender, service); derr != nil {
+		return nil, derr
+	}
+	data, _, err := d.server.serviceData(service)
+	if err != nil {
+		return nil, dbusError(err.Code, err.Message)
+	}
+	list, _ := data.([]*alpm.Pkg)
+	pkgs := []dbusPkg{}
+	for _, p := range list {
+		pkgs = append(pkgs, dbusPkg{p.Name, p.LocalVersion, p.RemoteVersion,
+			p.Foreign, p.Repo, p.BuildDate, p.Description, p.Arch,
+			p.DownloadSize, p.InstalledSizeDelta, p.Packager, p.Groups, p.URL})
+	}
+	return pkgs, nil
+}
+
+// Sync forces a database sync and returns the status, the job id
+// and the seconds until a new sync is allowed if it was throttled
+func (d *dbusService) Sync(sender dbus.Sender) (string, int32, float64, *dbus.Error) {
+	if derr := d.allows(sender, "sync"); derr != nil {
+		return "", 0, 0, derr
+	}
+	v, ok := d.server.services["sync"]
+	if !ok {
+		return "", 0, 0, dbusError(ErrUnknownService, "sync service is not enabled")
+	}
+	r, ok := v.(syncRequester)
+	if !ok {
+		return "", 0, 0, dbusError(ErrUnknownService, "sync service has no jobs")
+	}
+	result := r.RequestSync()
+	return result.Status, int32(result.Job), result.RetryAfter, nil
+}
+
+// GetStatus returns the run metadata of every service keyed by
+// service name
+func (d *dbusService) GetStatus(sender dbus.Sender) (map[string]dbusStatus, *dbus.Error) {
+	if derr := d.allows(sender, "status"); derr != nil {
+		return nil, derr
+	}
+	unix := func(t *time.Time) int64 {
+		if t == nil {
+			return 0
+		}
+		return t.Unix()
+	}
+	status := make(map[string]dbusStatus)
+	for k, v := range d.server.services {
+		st := v.GetStatus()
+		status[k] = dbusStatus{unix(st.LastStart), unix(st.LastEnd),
+			unix(st.LastSuccess), st.Duration, st.LastError, unix(st.NextRun),
+			st.Running}
+	}
+	return status, nil
+}
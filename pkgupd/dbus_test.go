@@ -0,0 +1,177 @@
+package main
+
+import "bufio"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+import "pkgupd/alpm"
+import "github.com/godbus/dbus"
+
+// Configuration of the private bus the tests run against
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-BUS Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:tmpdir=/tmp</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// staticService is a data service whose data is set by the test
+type staticService struct {
+	data      []*alpm.Pkg
+	listeners []Listener
+	mutex     *sync.Mutex
+}
+
+func (s *staticService) Start()                    {}
+func (s *staticService) Stop()                     {}
+func (s *staticService) Wait()                     {}
+func (s *staticService) ProcessEvent(string)       {}
+func (s *staticService) SendMessage(string)        {}
+func (s *staticService) GetStatus() *ServiceStatus { return &ServiceStatus{} }
+
+func (s *staticService) AddListener(l Listener) {
+	s.listeners = append(s.listeners, l)
+}
+
+func (s *staticService) GetData() (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.data, nil
+}
+
+// update replaces the data and notifies the listeners
+func (s *staticService) update(pkgs []*alpm.Pkg) {
+	s.mutex.Lock()
+	s.data = pkgs
+	s.mutex.Unlock()
+	for _, l := range s.listeners {
+		l.ProcessEvent("update_finished")
+	}
+}
+
+// startTestBus starts a private dbus-daemon and returns its address
+func startTestBus(t *testing.T) (string, func()) {
+	bin, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	dir, err := ioutil.TempDir("", "pkgupd-dbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "bus.conf")
+	if err = ioutil.WriteFile(conf, []byte(testBusConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, "--config-file="+conf, "--nofork", "--print-address")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Skip("could not start dbus-daemon:", err)
+	}
+	addr, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		cmd.Process.Kill()
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(addr), func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDBus(t *testing.T) {
+	addr, stop := startTestBus(t)
+	defer stop()
+
+	server := NewServer(false)
+	repo := &staticService{mutex: &sync.Mutex{}}
+	repo.data = []*alpm.Pkg{{Name: "linux", LocalVersion: "4.7.1-1",
+		RemoteVersion: "4.7.2-1", Repo: "core"}}
+	server.AddService("repo", repo)
+	go server.ServeDBus(addr)
+	defer func() {
+		server.Stop()
+		server.Wait()
+	}()
+
+	conn, err := connectDBus(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; ; i++ {
+		var owned bool
+		err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0,
+			DBusName).Store(&owned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owned {
+			break
+		}
+		if i == 100 {
+			t.Fatal("daemon did not claim its name")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0,
+		"type='signal',interface='"+DBusInterface+"'")
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+
+	obj := conn.Object(DBusName, DBusPath)
+	var pkgs []dbusPkg
+	if err = obj.Call(DBusInterface+".GetUpdates", 0, "repo").Store(&pkgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 1 || pkgs[0].Name != "linux" || pkgs[0].Repo != "core" {
+		t.Errorf("unexpected updates %v", pkgs)
+	}
+
+	err = obj.Call(DBusInterface+".Sync", 0).Err
+	if derr, ok := err.(dbus.Error); !ok || derr.Name != DBusInterface+".Error."+ErrUnknownService {
+		t.Errorf("unexpected sync error %v", err)
+	}
+
+	var status map[string]dbusStatus
+	if err = obj.Call(DBusInterface+".GetStatus", 0).Store(&status); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := status["repo"]; !ok || len(status) != 1 {
+		t.Errorf("unexpected status %v", status)
+	}
+
+	repo.update(append(repo.data, &alpm.Pkg{Name: "firefox",
+		LocalVersion: "48.0-1", RemoteVersion: "49.0-1", Repo: "extra"}))
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case sig := <-signals:
+			if sig.Name != DBusInterface+".UpdatesChanged" {
+				continue
+			}
+			if len(sig.Body) != 2 || sig.Body[0] != "repo" {
+				t.Errorf("unexpected signal %v", sig)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no UpdatesChanged signal")
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import "errors"
+import "path"
+import "regexp"
+import "sort"
+import "strings"
+import "unicode"
+import "pkgupd/alpm"
+
+// Sort keys of package lists
+const (
+	SortName   = "name"
+	SortRepo   = "repo"
+	SortChange = "change"
+)
+
+// pkgFields maps the package fields that can be projected to
+// their accessors
+var pkgFields = map[string]func(p *alpm.Pkg) interface{}{
+	"Name":               func(p *alpm.Pkg) interface{} { return p.Name },
+	"LocalVersion":       func(p *alpm.Pkg) interface{} { return p.LocalVersion },
+	"RemoteVersion":      func(p *alpm.Pkg) interface{} { return p.RemoteVersion },
+	"Foreign":            func(p *alpm.Pkg) interface{} { return p.Foreign },
+	"Repo":               func(p *alpm.Pkg) interface{} { return p.Repo },
+	"BuildDate":          func(p *alpm.Pkg) interface{} { return p.BuildDate },
+	"Description":        func(p *alpm.Pkg) interface{} { return p.Description },
+	"Arch":               func(p *alpm.Pkg) interface{} { return p.Arch },
+	"DownloadSize":       func(p *alpm.Pkg) interface{} { return p.DownloadSize },
+	"InstalledSizeDelta": func(p *alpm.Pkg) interface{} { return p.InstalledSizeDelta },
+	"Packager":           func(p *alpm.Pkg) interface{} { return p.Packager },
+	"Groups":             func(p *alpm.Pkg) interface{} { return p.Groups },
+	"URL":                func(p *alpm.Pkg) interface{} { return p.URL },
+}
+
+// PkgFilter selects, sorts and projects the package lists of the
+// repo and aur services before they are sent to the client. All
+// conditions must match for a package to be included
+type PkgFilter struct {
+	// Shell glob matched against the package name
+	Name string `json:"Name,omitempty"`
+	// Regular expression matched against the package name
+	Regex string `json:"Regex,omitempty"`
+	// Only include packages from these repositories
+	Repos []string `json:"Repos,omitempty"`
+	// Only include foreign packages
+	Foreign bool `json:"Foreign,omitempty"`
+	// Only include packages built after this unix timestamp
+	NewerThan int64 `json:"NewerThan,omitempty"`
+	// Sort key: name, repo or change. Empty keeps the service order
+	Sort string `json:"Sort,omitempty"`
+	// Package fields included in the response; empty means all
+	Fields []string `json:"Fields,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// compile validates the filter and compiles its regular expression.
+// It must be called before the filter is applied
+func (f *PkgFilter) compile() error {
+	if f.Name != "" {
+		if _, err := path.Match(f.Name, ""); err != nil {
+			return errors.New("invalid name pattern " + f.Name)
+		}
+	}
+	if f.Regex != "" {
+		re, err := regexp.Compile(f.Regex)
+		if err != nil {
+			return errors.New("invalid regular expression: " + err.Error())
+		}
+		f.regex = re
+	}
+	switch f.Sort {
+	case "", SortName, SortRepo, SortChange:
+	default:
+		return errors.New("invalid sort key " + f.Sort)
+	}
+	for _, field := range f.Fields {
+		if _, ok := pkgFields[field]; !ok {
+			return errors.New("invalid field " + field)
+		}
+	}
+	return nil
+}
+
+// matches returns true if the package passes all the conditions
+// of the filter
+func (f *PkgFilter) matches(p *alpm.Pkg) bool {
+	if f.Name != "" {
+		if ok, _ := path.Match(f.Name, p.Name); !ok {
+			return false
+		}
+	}
+	if f.regex != nil && !f.regex.MatchString(p.Name) {
+		return false
+	}
+	if len(f.Repos) != 0 && !stringInList(f.Repos, p.Repo) {
+		return false
+	}
+	if f.Foreign && !p.Foreign {
+		return false
+	}
+	if f.NewerThan != 0 && p.BuildDate <= f.NewerThan {
+		return false
+	}
+	return true
+}
+
+// apply filters and sorts a copy of the package list and projects
+// the requested fields. Data that is not a package list is returned
+// unchanged
+func (f *PkgFilter) apply(data interface{}) interface{} {
+	pkgs, ok := data.([]*alpm.Pkg)
+	if f == nil || !ok {
+		return data
+	}
+	result := []*alpm.Pkg{}
+	for _, p := range pkgs {
+		if f.matches(p) {
+			result = append(result, p)
+		}
+	}
+	switch f.Sort {
+	case SortName:
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].Name < result[j].Name
+		})
+	case SortRepo:
+		sort.SliceStable(result, func(i, j int) bool {
+			if result[i].Repo != result[j].Repo {
+				return result[i].Repo < result[j].Repo
+			}
+			return result[i].Name < result[j].Name
+		})
+	case SortChange:
+		sort.SliceStable(result, func(i, j int) bool {
+			ci := versionChange(result[i].LocalVersion, result[i].RemoteVersion)
+			cj := versionChange(result[j].LocalVersion, result[j].RemoteVersion)
+			if ci != cj {
+				return ci > cj
+			}
+			return result[i].Name < result[j].Name
+		})
+	}
+	if len(f.Fields) == 0 {
+		return result
+	}
+	projected := []map[string]interface{}{}
+	for _, p := range result {
+		entry := make(map[string]interface{})
+		for _, field := range f.Fields {
+			entry[field] = pkgFields[field](p)
+		}
+		projected = append(projected, entry)
+	}
+	return projected
+}
+
+// splitVersion splits a version string of the form epoch:pkgver-pkgrel
+// into its parts. The epoch defaults to 0
+func splitVersion(version string) (string, string, string) {
+	epoch := "0"
+	if i := strings.Index(version, ":"); i != -1 {
+		epoch, version = version[:i], version[i+1:]
+	}
+	rel := ""
+	if i := strings.LastIndex(version, "-"); i != -1 {
+		version, rel = version[:i], version[i+1:]
+	}
+	return epoch, version, rel
+}
+
+// versionChange estimates the magnitude of an update from version
+// from to version to: 4 if the epoch changed, 3 if the first component
+// of pkgver changed, 2 if the second one changed, 1 for any other pkgver
+// change and 0 if only pkgrel changed
+func versionChange(from string, to string) int {
+	fepoch, fver, _ := splitVersion(from)
+	tepoch, tver, _ := splitVersion(to)
+	if fepoch != tepoch {
+		return 4
+	}
+	isSep := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+	fparts := strings.FieldsFunc(fver, isSep)
+	tparts := strings.FieldsFunc(tver, isSep)
+	for i := 0; i < len(fparts) || i < len(tparts); i++ {
+		if i >= len(fparts) || i >= len(tparts) || fparts[i] != tparts[i] {
+			switch i {
+			case 0:
+				return 3
+			case 1:
+				return 2
+			default:
+				return 1
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+import "pkgupd/alpm"
+
+func TestVersionChange(t *testing.T) {
+	cases := []struct {
+		from, to string
+		change   int
+	}{
+		{"1.2.3-1", "1.2.3-2", 0},
+		{"1.2.3-1", "1.2.4-1", 1},
+		{"1.2.3-1", "1.3.0-1", 2},
+		{"1.2.3-1", "2.0.0-1", 3},
+		{"1.2.3-1", "1:1.2.3-1", 4},
+		{"1.2-1", "1.2.1-1", 1},
+	}
+	for _, c := range cases {
+		if v := versionChange(c.from, c.to); v != c.change {
+			t.Errorf("versionChange(%s, %s) = %d, want %d", c.from, c.to, v, c.change)
+		}
+	}
+}
+
+func TestPkgFilter(t *testing.T) {
+	pkgs := []*alpm.Pkg{
+		{Name: "linux", LocalVersion: "4.7.1-1", RemoteVersion: "4.7.2-1",
+			Repo: "core", BuildDate: 200},
+		{Name: "firefox", LocalVersion: "48.0-1", RemoteVersion: "49.0-1",
+			Repo: "extra", BuildDate: 300},
+		{Name: "yaourt", LocalVersion: "1.8-1", RemoteVersion: "1.8.1-1",
+			Foreign: true, Repo: "aur", BuildDate: 100},
+	}
+
+	f := &PkgFilter{Sort: SortChange}
+	if err := f.compile(); err != nil {
+		t.Fatal(err)
+	}
+	res := f.apply(pkgs).([]*alpm.Pkg)
+	if len(res) != 3 || res[0].Name != "firefox" || res[2].Name != "yaourt" {
+		t.Errorf("unexpected order %v", res)
+	}
+	if pkgs[0].Name != "linux" {
+		t.Error("filter must not reorder the service data")
+	}
+
+	f = &PkgFilter{Regex: "^(linux|yaourt)$", NewerThan: 150}
+	if err := f.compile(); err != nil {
+		t.Fatal(err)
+	}
+	res = f.apply(pkgs).([]*alpm.Pkg)
+	if len(res) != 1 || res[0].Name != "linux" {
+		t.Errorf("unexpected result %v", res)
+	}
+
+	f = &PkgFilter{Name: "*o*", Repos: []string{"aur"}, Fields: []string{"Name"}}
+	if err := f.compile(); err != nil {
+		t.Fatal(err)
+	}
+	proj := f.apply(pkgs).([]map[string]interface{})
+	if len(proj) != 1 || len(proj[0]) != 1 || proj[0]["Name"] != "yaourt" {
+		t.Errorf("unexpected projection %v", proj)
+	}
+
+	for _, f := range []*PkgFilter{{Regex: "("}, {Sort: "size"},
+		{Fields: []string{"Size"}}, {Name: "["}} {
+		if err := f.compile(); err == nil {
+			t.Errorf("filter %+v should be invalid", f)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build cgo
+
+package main
+
+import "pkgupd/alpm"
+
+// newLibalpm returns the libalpm backend for the pacman library lib
+func newLibalpm(lib string) (alpm.Backend, error) {
+	libalpm, err := alpm.NewAlpm("/", lib)
+	if err != nil {
+		return nil, err
+	}
+	return libalpm, nil
+}
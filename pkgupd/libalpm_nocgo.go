@@ -0,0 +1,11 @@
+//go:build !cgo
+
+package main
+
+import "errors"
+import "pkgupd/alpm"
+
+// newLibalpm fails since libalpm is only available with cgo
+func newLibalpm(lib string) (alpm.Backend, error) {
+	return nil, errors.New("built without cgo, use --backend go")
+}
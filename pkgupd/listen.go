@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+import "net/url"
+import "strings"
+
+// Request types that modify the server state and are denied on
+// read-only listeners
+var writeRequestTypes = []string{"sync"}
+
+// ListenerPolicy restricts the request types that are served on
+// a listener
+type ListenerPolicy struct {
+	// Allowed request types; empty allows all request types
+	Allow []string
+	// Denied request types; these take precedence over Allow
+	Deny []string
+}
+
+// Allows returns true if the request type may be served under this
+// policy. A nil policy allows everything.
+func (p *ListenerPolicy) Allows(requestType string) bool {
+	if p == nil {
+		return true
+	}
+	if stringInList(p.Deny, requestType) {
+		return false
+	}
+	return len(p.Allow) == 0 || stringInList(p.Allow, requestType)
+}
+
+// ListenSpec is a listener as specified on the command line
+type ListenSpec struct {
+	Proto  string
+	Addr   string
+	Policy *ListenerPolicy
+}
+
+// parseListenSpec parses a listener specification of the form
+// tcp://addr:port?options or unix:///path/to/socket?options. The form
+// fd://name?options sets the policy of the sockets passed by systemd
+// socket activation with the FileDescriptorName name. Options
+// are "allow" and "deny", both taking a comma separated list of
+// request types, and "readonly" which denies all request types that
+// modify the server state.
+func parseListenSpec(spec string) (*ListenSpec, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	ret := &ListenSpec{Proto: strings.ToLower(u.Scheme), Policy: &ListenerPolicy{}}
+	switch ret.Proto {
+	case "tcp":
+		ret.Addr = u.Host
+	case "unix":
+		ret.Addr = u.Path
+	case "fd":
+		ret.Addr = u.Host
+	default:
+		return nil, fmt.Errorf("invalid protocol '%s' in listener %s", u.Scheme, spec)
+	}
+	if ret.Addr == "" {
+		return nil, fmt.Errorf("missing address in listener %s", spec)
+	}
+	query := u.Query()
+	for k, v := range query {
+		switch k {
+		case "allow":
+			ret.Policy.Allow = append(ret.Policy.Allow, splitList(v)...)
+		case "deny":
+			ret.Policy.Deny = append(ret.Policy.Deny, splitList(v)...)
+		case "readonly":
+			ret.Policy.Deny = append(ret.Policy.Deny, writeRequestTypes...)
+		default:
+			return nil, fmt.Errorf("invalid option '%s' in listener %s", k, spec)
+		}
+	}
+	return ret, nil
+}
+
+// splitList splits comma separated query values into a single list
+func splitList(values []string) []string {
+	var ret []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				ret = append(ret, item)
+			}
+		}
+	}
+	return ret
+}
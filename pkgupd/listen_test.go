@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestParseListenSpec(t *testing.T) {
+	spec, err := parseListenSpec("unix:///run/pkgupd/pkgupd.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Proto != "unix" || spec.Addr != "/run/pkgupd/pkgupd.sock" {
+		t.Errorf("unexpected spec %+v", spec)
+	}
+	if !spec.Policy.Allows("sync") || !spec.Policy.Allows("repo") {
+		t.Error("empty policy should allow everything")
+	}
+
+	spec, err = parseListenSpec("tcp://127.0.0.1:7356?readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Proto != "tcp" || spec.Addr != "127.0.0.1:7356" {
+		t.Errorf("unexpected spec %+v", spec)
+	}
+	if spec.Policy.Allows("sync") || !spec.Policy.Allows("repo") {
+		t.Error("readonly policy should only deny sync")
+	}
+
+	spec, err = parseListenSpec("tcp://:7356?allow=repo,aur&deny=aur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spec.Policy.Allows("repo") || spec.Policy.Allows("aur") ||
+		spec.Policy.Allows("hello") {
+		t.Errorf("unexpected policy %+v", spec.Policy)
+	}
+
+	spec, err = parseListenSpec("fd://pkgupd?readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Proto != "fd" || spec.Addr != "pkgupd" || spec.Policy.Allows("sync") {
+		t.Errorf("unexpected spec %+v", spec)
+	}
+
+	for _, v := range []string{"udp://:7356", "tcp://", "unix:///tmp/s?foo", "fd://"} {
+		if _, err := parseListenSpec(v); err == nil {
+			t.Errorf("listener %s should be invalid", v)
+		}
+	}
+}
@@ -8,10 +8,16 @@ type Options struct {
 	EnableSync bool `short:"s" long:"enable-sync" description:"Enable automatic sync of dbs"`
 	// Enable AUR sync
 	EnableAUR bool `short:"a" long:"enable-aur" description:"Check foreign packages for updates in AUR"`
+	// Enable the preview of the system upgrade
+	EnablePreview bool `long:"enable-preview" description:"Preview the system upgrade and report conflicts and missing dependencies"`
 	// Interval between database sync (seconds)
 	SyncInterval int `long:"sync-interval" default:"1800" description:"Interval for database sync in seconds"`
 	// Interval between AUR sync (second)
 	AURInterval int `long:"aur-interval" default:"1800" description:"Interval for AUR checks"`
+	// Minimum interval between client-triggered syncs (seconds)
+	MinSyncInterval int `long:"min-sync-interval" default:"60" description:"Minimum interval between client-triggered syncs in seconds"`
+	// Backend reading the local and sync databases
+	Backend string `long:"backend" default:"libalpm" choice:"libalpm" choice:"go" description:"Read the databases with libalpm or with the pure Go reader"`
 	// Path of the pacman.conf
 	PacmanConf flags.Filename `long:"pacman-conf" default:"/etc/pacman.conf" description:"Pacman configuration file"`
 	// Interval between regular repo update
@@ -24,6 +30,38 @@ type Options struct {
 	ListenType string `short:"l" long:"listen-type" default:"unix" description:"Server listening protocol, 'tcp' or 'unix'"`
 	// Address of the listening socket for tcp or socket path for unix
 	ListenAddr string `short:"r" long:"listen-addr" default:"/tmp/pkgupd.sock" description:"Address (addr:port) or socket of the server"`
+	// Listeners with a per-listener policy; these replace ListenType/ListenAddr
+	Listen []string `long:"listen" description:"Listener as tcp://addr:port, unix:///path or fd://name (activated sockets) with optional ?readonly, ?allow=... or ?deny=... policy; can be repeated"`
+	// Server certificate for TLS on TCP listeners
+	TLSCert flags.Filename `long:"tls-cert" description:"Server certificate, enables TLS on TCP listeners"`
+	// Server key for TLS on TCP listeners
+	TLSKey flags.Filename `long:"tls-key" description:"Server certificate key"`
+	// CA bundle for client certificates
+	TLSClientCA flags.Filename `long:"tls-client-ca" description:"Require client certificates signed by these CAs"`
+	// File containing the token TCP clients must authenticate with
+	TokenFile flags.Filename `long:"token-file" description:"File with the token required from TCP clients"`
+	// Mode of the unix sockets
+	SocketMode string `long:"socket-mode" default:"0666" description:"Permissions of the unix sockets (octal)"`
+	// Group of the unix sockets
+	SocketGroup string `long:"socket-group" description:"Group owning the unix sockets"`
+	// Per request type allow-lists for unix socket peers
+	PeerAllow []string `long:"peer-allow" description:"Restrict a request type on unix sockets, as REQUEST=user:NAME,group:NAME,...; can be repeated"`
+	// Time after which idle clients are disconnected (seconds)
+	IdleTimeout int `long:"idle-timeout" default:"60" description:"Disconnect clients idle for this many seconds, 0 to disable"`
+	// Maximum number of concurrent client connections
+	MaxConnections int `long:"max-connections" default:"128" description:"Maximum number of concurrent connections, 0 for no limit"`
+	// Time requests and syncs in progress get to finish on shutdown (seconds)
+	GracePeriod int `long:"grace-period" default:"10" description:"Seconds requests and syncs in progress get to finish on shutdown"`
+	// Type of the HTTP API listening socket (tcp or unix)
+	HTTPType string `long:"http-type" default:"tcp" description:"HTTP API listening protocol, 'tcp' or 'unix'"`
+	// Address of the HTTP API socket; the API is disabled if empty
+	HTTPAddr string `long:"http-addr" description:"Address (addr:port), socket or listener (as in --listen) of the HTTP API, disabled if empty"`
+	// Export the daemon on D-Bus
+	DBus bool `long:"dbus" description:"Export the daemon on the D-Bus system bus"`
+	// Address of the bus used instead of the system bus
+	DBusAddress string `long:"dbus-address" description:"Address of the D-Bus bus to use instead of the system bus"`
+	// File keeping the snapshots of the services across restarts
+	SnapshotFile flags.Filename `long:"snapshot-file" description:"File keeping the update snapshots across restarts, default is snapshots.json in the db root"`
 	// Enable automatic updates when the pacman database changes
 	NotifyFS bool `short:"m" long:"monitor-changes" description:"Monitor pacman database for changes"`
 }
@@ -0,0 +1,217 @@
+package main
+
+import "context"
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "os"
+import "os/user"
+import "strconv"
+import "strings"
+import "syscall"
+
+// peerCred holds the credentials of the process on the other end
+// of a unix socket
+type peerCred struct {
+	uid uint32
+	// Primary and supplementary groups
+	gids []uint32
+}
+
+// PeerRule lists the users and groups allowed to send a request type
+type PeerRule struct {
+	Users  []uint32
+	Groups []uint32
+}
+
+// PeerPolicy maps request types to the peers that are allowed to send
+// them over unix sockets. Request types without a rule are allowed for
+// everyone; the rule of "*" applies to all request types without their
+// own rule. Root is always allowed.
+type PeerPolicy map[string]*PeerRule
+
+// Allows returns true if the peer may send the request type
+func (p PeerPolicy) Allows(requestType string, cred *peerCred) bool {
+	if cred == nil || cred.uid == 0 {
+		return true
+	}
+	rule, ok := p[requestType]
+	if !ok {
+		if rule, ok = p["*"]; !ok {
+			return true
+		}
+	}
+	for _, uid := range rule.Users {
+		if uid == cred.uid {
+			return true
+		}
+	}
+	for _, gid := range rule.Groups {
+		for _, g := range cred.gids {
+			if gid == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parsePeerRule parses a rule of the form
+// REQUEST=user:NAME|UID,group:NAME|GID,... and adds it to the policy
+func (p PeerPolicy) parsePeerRule(spec string) error {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid peer rule %s", spec)
+	}
+	rule, ok := p[parts[0]]
+	if !ok {
+		rule = &PeerRule{}
+		p[parts[0]] = rule
+	}
+	for _, entry := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid entry '%s' in peer rule %s", entry, spec)
+		}
+		switch kv[0] {
+		case "user":
+			uid, err := lookupUID(kv[1])
+			if err != nil {
+				return err
+			}
+			rule.Users = append(rule.Users, uid)
+		case "group":
+			gid, err := lookupGID(kv[1])
+			if err != nil {
+				return err
+			}
+			rule.Groups = append(rule.Groups, gid)
+		default:
+			return fmt.Errorf("invalid entry '%s' in peer rule %s", entry, spec)
+		}
+	}
+	return nil
+}
+
+// lookupUID returns the uid of a user name or numeric uid
+func lookupUID(name string) (uint32, error) {
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(uid), err
+}
+
+// lookupGID returns the gid of a group name or numeric gid
+func lookupGID(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(gid), err
+}
+
+// getPeerCred reads SO_PEERCRED of a unix connection and resolves the
+// supplementary groups of the peer. Returns nil for other connections.
+func getPeerCred(conn net.Conn) (*peerCred, error) {
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil
+	}
+	raw, err := uconn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return newPeerCred(ucred.Uid, ucred.Gid), nil
+}
+
+// newPeerCred creates the credentials of a peer with the specified
+// uid and primary gid and resolves its supplementary groups
+func newPeerCred(uid uint32, gid uint32) *peerCred {
+	cred := &peerCred{uid: uid, gids: []uint32{gid}}
+	if u, err := user.LookupId(strconv.Itoa(int(uid))); err == nil {
+		if groups, err := u.GroupIds(); err == nil {
+			for _, g := range groups {
+				if gid, err := strconv.ParseUint(g, 10, 32); err == nil {
+					cred.gids = append(cred.gids, uint32(gid))
+				}
+			}
+		}
+	}
+	return cred
+}
+
+// SetPeerPolicy parses the peer rules that restrict the request types
+// over unix sockets
+func (s *Server) SetPeerPolicy(rules []string) error {
+	policy := make(PeerPolicy)
+	for _, r := range rules {
+		if err := policy.parsePeerRule(r); err != nil {
+			return err
+		}
+	}
+	s.peerPolicy = policy
+	return nil
+}
+
+// SetSocketPermissions sets the mode and, if not empty, the group of
+// the unix sockets created by the server
+func (s *Server) SetSocketPermissions(mode string, group string) error {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return errors.New("invalid socket mode " + mode)
+	}
+	s.socketMode = os.FileMode(m)
+	s.socketGroup = -1
+	if group != "" {
+		gid, err := lookupGID(group)
+		if err != nil {
+			return err
+		}
+		s.socketGroup = int(gid)
+	}
+	return nil
+}
+
+type peerCredKey struct{}
+
+// peerCredContext stores the peer credentials of HTTP connections
+// in the request context
+func peerCredContext(ctx context.Context, conn net.Conn) context.Context {
+	if lc, ok := conn.(*limitConn); ok {
+		conn = lc.Conn
+	}
+	cred, err := getPeerCred(conn)
+	if err != nil {
+		// deny everything that has a rule
+		cred = &peerCred{uid: ^uint32(0)}
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// httpPeerCred returns the peer credentials of an HTTP request
+func httpPeerCred(r *http.Request) *peerCred {
+	cred, _ := r.Context().Value(peerCredKey{}).(*peerCred)
+	return cred
+}
@@ -0,0 +1,135 @@
+package main
+
+import "context"
+import "encoding/json"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path"
+import "runtime"
+import "sync"
+import "syscall"
+import "testing"
+import "time"
+
+func TestPeerPolicy(t *testing.T) {
+	policy := make(PeerPolicy)
+	if err := policy.parsePeerRule("sync=user:1000,group:10"); err != nil {
+		t.Fatal(err)
+	}
+	member := &peerCred{uid: 1001, gids: []uint32{100, 10}}
+	owner := &peerCred{uid: 1000, gids: []uint32{100}}
+	other := &peerCred{uid: 1002, gids: []uint32{100}}
+	root := &peerCred{uid: 0, gids: []uint32{0}}
+
+	for _, cred := range []*peerCred{member, owner, other, root, nil} {
+		if !policy.Allows("repo", cred) {
+			t.Errorf("repo should be allowed for %+v", cred)
+		}
+	}
+	for _, cred := range []*peerCred{member, owner, root, nil} {
+		if !policy.Allows("sync", cred) {
+			t.Errorf("sync should be allowed for %+v", cred)
+		}
+	}
+	if policy.Allows("sync", other) {
+		t.Error("sync should not be allowed for other users")
+	}
+
+	if err := policy.parsePeerRule("*=user:1000"); err != nil {
+		t.Fatal(err)
+	}
+	if policy.Allows("repo", other) || !policy.Allows("repo", owner) {
+		t.Error("default rule should apply to request types without a rule")
+	}
+
+	for _, v := range []string{"sync", "=user:1000", "sync=uid:1000", "sync=user"} {
+		if err := policy.parsePeerRule(v); err == nil {
+			t.Errorf("peer rule %s should be invalid", v)
+		}
+	}
+}
+
+// dialUnprivileged connects to the unix socket addr as an unprivileged
+// user. If the test runs as root only the effective uid of the thread
+// connecting is changed; the thread exits with the goroutine
+func dialUnprivileged(addr string) (net.Conn, error) {
+	if os.Getuid() != 0 {
+		return net.Dial("unix", addr)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		runtime.LockOSThread()
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SETRESUID, ^uintptr(0), 65534, ^uintptr(0))
+		if errno != 0 {
+			done <- result{nil, errno}
+			return
+		}
+		conn, err := net.Dial("unix", addr)
+		done <- result{conn, err}
+	}()
+	r := <-done
+	return r.conn, r.err
+}
+
+func TestAPIPeerPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgupd-peercred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+	addr := path.Join(dir, "http.sock")
+	server := NewServer(false)
+	server.AddService("sync", &staticSyncService{staticService{mutex: &sync.Mutex{}}, nil})
+	if err = server.SetPeerPolicy([]string{"sync=user:0"}); err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeAPI("unix", addr, nil)
+	defer server.Stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) {
+			return dialUnprivileged(addr)
+		}}, Timeout: 5 * time.Second}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Post("http://pkgupd"+APIPrefix+"sync", "", nil); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the sync to be forbidden, got %s", resp.Status)
+	}
+}
+
+func TestAPISyncWaitPolicy(t *testing.T) {
+	server := NewServer(false)
+	server.AddService("sync", &staticSyncService{staticService{mutex: &sync.Mutex{}}, nil})
+	server.AddService("repo", &staticService{mutex: &sync.Mutex{}})
+	server.peerPolicy = PeerPolicy{"repo": &PeerRule{}}
+	r := httptest.NewRequest("POST", APIPrefix+"sync?wait=1", nil)
+	r = r.WithContext(context.WithValue(r.Context(), peerCredKey{}, &peerCred{uid: 1000}))
+
+	// a peer that may sync but not read repo gets no repo data
+	w := httptest.NewRecorder()
+	server.apiSync(w, r)
+	var resp struct{ Data SyncWaitResult }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if res := resp.Data.Updates["repo"]; res == nil || res.Code != ErrForbidden {
+		t.Errorf("expected the repo data to be forbidden, got %s", w.Body)
+	}
+}
@@ -281,29 +281,46 @@ func main() {
 		}
 	}
 
-	libalpm, err := alpm.NewAlpm("/", string(opts.DBRoot))
-	if err != nil {
-		log.Errorln("Could not initialize libalpm:", err)
-		os.Exit(1)
+	var backend alpm.Backend
+	if opts.Backend == "go" {
+		if opts.EnableSync || opts.EnablePreview {
+			log.ErrorFatal("--enable-sync and --enable-preview require --backend libalpm")
+		}
+		log.Infoln("Reading the databases without libalpm")
+		reader, err := alpm.NewReader(string(opts.DBRoot))
+		if err != nil {
+			log.ErrorFatal("Could not initialize the database reader:", err)
+		}
+		backend = reader
+	} else {
+		backend, err = newLibalpm(string(opts.DBRoot))
+		if err != nil {
+			log.Errorln("Could not initialize libalpm:", err)
+			os.Exit(1)
+		}
 	}
 	for k, v := range conf {
 		if k == "options" {
 			continue
 		}
-		servers := alpm.GetServersFromConf(v, k, arch)
-		libalpm.AddDatabase(k, servers)
+		backend.AddDatabase(k, alpm.GetServersFromConf(v, k, arch))
 	}
 
 	server := NewServer(opts.NotifyFS)
 	services := make(map[string]DataService)
-	services["repo"] = NewRepoService(time.Duration((opts.PollInterval))*time.Second, libalpm, conf)
+	services["repo"] = NewRepoService(time.Duration((opts.PollInterval))*time.Second, backend, conf)
 	if opts.EnableAUR {
 		log.Infoln("Enabling AUR Service")
-		services["aur"] = NewAURService(time.Duration(opts.AURInterval)*time.Second, libalpm)
+		services["aur"] = NewAURService(time.Duration(opts.AURInterval)*time.Second, backend)
+	}
+	if opts.EnablePreview {
+		log.Infoln("Enabling Preview Service")
+		services["preview"] = NewPreviewService(time.Duration(opts.PollInterval)*time.Second, backend)
 	}
 	if opts.EnableSync {
 		log.Infoln("Enabling Sync Service")
-		syncService := NewSyncService(time.Duration(opts.SyncInterval)*time.Second, libalpm)
+		syncService := NewSyncService(time.Duration(opts.SyncInterval)*time.Second, backend)
+		syncService.MinForceInterval = time.Duration(opts.MinSyncInterval) * time.Second
 		for _, v := range services {
 			syncService.AddListener(v)
 		}
@@ -314,10 +331,104 @@ func main() {
 		server.AddService(k, v)
 	}
 
+	snapshotFile := string(opts.SnapshotFile)
+	if snapshotFile == "" {
+		snapshotFile = path.Join(string(opts.DBRoot), "snapshots.json")
+	}
+	if err = server.SetSnapshotFile(snapshotFile); err != nil {
+		log.Errorln("Could not load snapshots, starting afresh:", err)
+	}
+
+	server.SetConnectionLimits(time.Duration(opts.IdleTimeout)*time.Second,
+		opts.MaxConnections)
+	server.SetGracePeriod(time.Duration(opts.GracePeriod) * time.Second)
+	if err = server.SetSocketPermissions(opts.SocketMode, opts.SocketGroup); err != nil {
+		log.ErrorFatal("Invalid socket permissions:", err)
+	}
+	if err = server.SetPeerPolicy(opts.PeerAllow); err != nil {
+		log.ErrorFatal("Invalid peer rule:", err)
+	}
+	if opts.TLSCert != "" {
+		err = server.EnableTLS(string(opts.TLSCert), string(opts.TLSKey),
+			string(opts.TLSClientCA))
+		if err != nil {
+			log.ErrorFatal("Could not enable TLS:", err)
+		}
+	}
+	if opts.TokenFile != "" {
+		if err = server.SetAuthToken(string(opts.TokenFile)); err != nil {
+			log.ErrorFatal("Could not read token:", err)
+		}
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
-	go server.Serve(opts.ListenType, opts.ListenAddr)
+	// Policies of activated sockets are given as fd://name listeners,
+	// all other listeners are created by the server
+	var specs []*ListenSpec
+	fdPolicies := make(map[string]*ListenerPolicy)
+	for _, v := range opts.Listen {
+		spec, err := parseListenSpec(v)
+		if err != nil {
+			log.ErrorFatal("Invalid listener:", err)
+		}
+		if spec.Proto == "fd" {
+			fdPolicies[spec.Addr] = spec.Policy
+		} else {
+			specs = append(specs, spec)
+		}
+	}
+
+	// The HTTP API address is either a plain address of --http-type
+	// or a listener with a policy
+	httpSpec := &ListenSpec{Proto: opts.HTTPType, Addr: opts.HTTPAddr}
+	if strings.Contains(opts.HTTPAddr, "://") {
+		if httpSpec, err = parseListenSpec(opts.HTTPAddr); err != nil {
+			log.ErrorFatal("Invalid HTTP API listener:", err)
+		}
+		if httpSpec.Proto == "fd" {
+			log.ErrorFatal("Invalid HTTP API listener: use --listen fd://" + APIFdName)
+		}
+	}
+
+	// Sockets passed by systemd take precedence over the configured
+	// listen addresses
+	activated, err := activationListeners()
+	if err != nil {
+		log.Errorln("Could not use activated sockets:", err)
+		os.Exit(1)
+	}
+	serving := false
+	servingAPI := false
+	for _, l := range activated {
+		if l.Name == APIFdName {
+			log.Infoln("Enabling HTTP API on activated socket")
+			go server.ServeAPIListener(l.Listener, fdPolicies[l.Name])
+			servingAPI = true
+		} else {
+			go server.ServeListener(l.Listener, fdPolicies[l.Name])
+			serving = true
+		}
+	}
+	if !serving && len(activated) == 0 && len(fdPolicies) != 0 {
+		log.Warnln("Not socket activated, ignoring fd:// listeners")
+	}
+	if !serving && len(specs) == 0 {
+		go server.Serve(opts.ListenType, opts.ListenAddr, nil)
+	} else if !serving {
+		for _, spec := range specs {
+			go server.Serve(spec.Proto, spec.Addr, spec.Policy)
+		}
+	}
+	if !servingAPI && opts.HTTPAddr != "" {
+		log.Infoln("Enabling HTTP API")
+		go server.ServeAPI(httpSpec.Proto, httpSpec.Addr, httpSpec.Policy)
+	}
+	if opts.DBus {
+		log.Infoln("Enabling D-Bus interface")
+		go server.ServeDBus(opts.DBusAddress)
+	}
 	server.Start()
 
 mainloop:
@@ -350,8 +461,8 @@ mainloop:
 	}
 
 	server.Stop()
-	log.Infoln("Waiting for server to stop")
+	log.Infoln("Waiting for requests and services to finish")
 	server.Wait()
-	libalpm.Close()
+	backend.Close()
 	log.Infoln("Exiting")
 }
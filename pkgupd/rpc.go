@@ -0,0 +1,174 @@
+package main
+
+import "bytes"
+import "encoding/json"
+
+// JSON-RPC 2.0 error codes. Errors of the server are reported as
+// RPCServerError with the error code of the protocol in the data
+// of the error object
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+	RPCServerError    = -32000
+)
+
+// Protocol name of the JSON-RPC 2.0 framing in hello requests
+const ProtocolJSONRPC = "jsonrpc"
+
+// rpcCall is a JSON-RPC 2.0 request. The method is the request
+// type and params holds the other fields of a Request. Calls
+// without an id are notifications and are not answered
+type rpcCall struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// rpcErrorData carries the error code of the protocol
+type rpcErrorData struct {
+	Code string `json:"Code"`
+}
+
+// rpcError is a JSON-RPC 2.0 error object
+type rpcError struct {
+	Code    int           `json:"code"`
+	Message string        `json:"message"`
+	Data    *rpcErrorData `json:"data,omitempty"`
+}
+
+// rpcResult is a successful JSON-RPC 2.0 response
+type rpcResult struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcErrorReply is a failed JSON-RPC 2.0 response
+type rpcErrorReply struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Error   *rpcError       `json:"error"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcNotification is sent to subscribed JSON-RPC clients for
+// every update event
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcErrorCode maps an error code of the protocol to a JSON-RPC
+// error code
+func rpcErrorCode(code string) int {
+	switch code {
+	case ErrMalformedRequest:
+		return RPCParseError
+	case ErrInvalidRequest, ErrRequestLength:
+		return RPCInvalidRequest
+	case ErrUnsupportedVersion, ErrInvalidFilter:
+		return RPCInvalidParams
+	case ErrInternal:
+		return RPCInternalError
+	}
+	return RPCServerError
+}
+
+func newRPCError(id json.RawMessage, code string, msg string) *rpcErrorReply {
+	return &rpcErrorReply{"2.0", &rpcError{rpcErrorCode(code), msg,
+		&rpcErrorData{code}}, id}
+}
+
+// newRPCReply converts the response to a request into a JSON-RPC
+// response for the call with the specified id
+func newRPCReply(id json.RawMessage, resp *Response) interface{} {
+	if resp.ResponseType != "error" {
+		return &rpcResult{"2.0", resp.Data, id}
+	}
+	msg, _ := resp.Data.(string)
+	if resp.Code == "" {
+		return &rpcErrorReply{"2.0", &rpcError{RPCServerError, msg, nil}, id}
+	}
+	return newRPCError(id, resp.Code, msg)
+}
+
+// isRPC returns true if the request line is a JSON-RPC call or batch
+func isRPC(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	if len(line) != 0 && line[0] == '[' {
+		return true
+	}
+	var probe struct {
+		JSONRPC *string `json:"jsonrpc"`
+	}
+	return json.Unmarshal(line, &probe) == nil && probe.JSONRPC != nil
+}
+
+// handleRPC answers a JSON-RPC call or batch and switches the client
+// to the JSON-RPC framing
+func (s *Server) handleRPC(c *client, line []byte) {
+	c.setRPC()
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] != '[' {
+		if reply := s.rpcCall(c, line); reply != nil {
+			c.writeJSON(reply)
+		}
+		return
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(line, &batch); err != nil {
+		c.writeJSON(newRPCError(nil, ErrMalformedRequest, "parse error"))
+		return
+	}
+	if len(batch) == 0 {
+		c.writeJSON(newRPCError(nil, ErrInvalidRequest, "empty batch"))
+		return
+	}
+	replies := []interface{}{}
+	for _, raw := range batch {
+		if reply := s.rpcCall(c, raw); reply != nil {
+			replies = append(replies, reply)
+		}
+	}
+	if len(replies) != 0 {
+		c.writeJSON(replies)
+	}
+}
+
+// rpcCall processes a single JSON-RPC call. It returns the response
+// or nil if the call is a notification
+func (s *Server) rpcCall(c *client, raw []byte) interface{} {
+	var call rpcCall
+	if err := json.Unmarshal(raw, &call); err != nil {
+		if !json.Valid(raw) {
+			return newRPCError(nil, ErrMalformedRequest, "parse error")
+		}
+		return newRPCError(nil, ErrInvalidRequest, "invalid request")
+	}
+	if call.JSONRPC != "2.0" || call.Method == "" {
+		return newRPCError(call.ID, ErrInvalidRequest, "invalid request")
+	}
+	req := &Request{}
+	if len(call.Params) != 0 && string(call.Params) != "null" {
+		if err := json.Unmarshal(call.Params, req); err != nil {
+			return &rpcErrorReply{"2.0", &rpcError{RPCInvalidParams,
+				"params must be an object", &rpcErrorData{ErrInvalidRequest}}, call.ID}
+		}
+	}
+	req.RequestType = call.Method
+	var reply interface{}
+	if _, ok := s.handlers[call.Method]; !ok && s.services[call.Method] == nil {
+		reply = &rpcErrorReply{"2.0", &rpcError{RPCMethodNotFound,
+			"unknown method " + call.Method, nil}, call.ID}
+	} else {
+		reply = newRPCReply(call.ID, s.processRequest(c, req))
+	}
+	if call.ID == nil {
+		return nil
+	}
+	return reply
+}
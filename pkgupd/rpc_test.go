@@ -0,0 +1,110 @@
+package main
+
+import "bufio"
+import "encoding/json"
+import "net"
+import "sync"
+import "testing"
+import "time"
+import "pkgupd/alpm"
+
+// rpcReply is a decoded JSON-RPC response or notification
+type rpcReply struct {
+	JSONRPC string
+	ID      json.RawMessage
+	Method  string
+	Result  json.RawMessage
+	Error   *rpcError
+}
+
+func TestJSONRPC(t *testing.T) {
+	server := NewServer(false)
+	repo := &staticService{mutex: &sync.Mutex{}}
+	repo.data = []*alpm.Pkg{{Name: "linux", LocalVersion: "4.7.1-1",
+		RemoteVersion: "4.7.2-1", Repo: "core"}}
+	server.AddService("repo", repo)
+	conn, peer := net.Pipe()
+	server.acquireConn(conn)
+	go server.handleRequest(conn, nil)
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(peer)
+
+	send := func(line string) {
+		if _, err := peer.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(v interface{}) {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(line, v); err != nil {
+			t.Fatalf("%s: %s", err, line)
+		}
+	}
+
+	// Handshake in the native framing, answered natively
+	send(`{"RequestType": "hello", "Protocol": "jsonrpc"}`)
+	var hello Response
+	read(&hello)
+	if hello.ResponseType != "ok" {
+		t.Fatalf("unexpected hello response %+v", hello)
+	}
+
+	send(`{"jsonrpc": "2.0", "method": "repo", "id": 1}`)
+	var reply rpcReply
+	read(&reply)
+	var pkgs []*alpm.Pkg
+	if string(reply.ID) != "1" || reply.Error != nil ||
+		json.Unmarshal(reply.Result, &pkgs) != nil || len(pkgs) != 1 {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+
+	// Notifications are not answered, errors keep their ids
+	send(`[{"jsonrpc": "2.0", "method": "repo"},` +
+		`{"jsonrpc": "2.0", "method": "nope", "id": "a"},` +
+		`{"jsonrpc": "2.0", "method": "repo", "params": [1], "id": 2},` +
+		`{"jsonrpc": "2.0", "method": "repo", "params": {"Filter": {"Regex": "("}}, "id": 3},` +
+		`{"method": "repo", "id": 4},` +
+		`{"jsonrpc": "2.0", "method": "subscribe", "id": 5}]`)
+	var batch []rpcReply
+	read(&batch)
+	expect := []struct {
+		id   string
+		code int
+	}{{`"a"`, RPCMethodNotFound}, {"2", RPCInvalidParams},
+		{"3", RPCInvalidParams}, {"4", RPCInvalidRequest}, {"5", 0}}
+	if len(batch) != len(expect) {
+		t.Fatalf("expected %d replies, got %+v", len(expect), batch)
+	}
+	for i, e := range expect {
+		if string(batch[i].ID) != e.id {
+			t.Errorf("reply %d: id %s, want %s", i, batch[i].ID, e.id)
+		}
+		if e.code == 0 && batch[i].Error != nil {
+			t.Errorf("reply %d: unexpected error %+v", i, batch[i].Error)
+		} else if e.code != 0 && (batch[i].Error == nil || batch[i].Error.Code != e.code) {
+			t.Errorf("reply %d: expected error %d, got %+v", i, e.code, batch[i].Error)
+		}
+	}
+
+	// The connection is in JSON-RPC mode now, even for broken lines
+	send(`{"RequestType": "repo"`)
+	read(&reply)
+	if reply.Error == nil || reply.Error.Code != RPCParseError || string(reply.ID) != "null" {
+		t.Errorf("expected parse error, got %+v", reply)
+	}
+
+	repo.update(append(repo.data, &alpm.Pkg{Name: "firefox",
+		LocalVersion: "48.0-1", RemoteVersion: "49.0-1", Repo: "extra"}))
+	var note struct {
+		rpcReply
+		Params UpdateEvent
+	}
+	read(&note)
+	if note.Method != "event" || note.ID != nil || note.Params.Service != "repo" {
+		t.Errorf("unexpected notification %+v", note)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import "encoding/json"
+import "reflect"
+import "strings"
+import "time"
+import "pkgupd/alpm"
+
+// Dialect of the generated schemas
+const SchemaDialect = "http://json-schema.org/draft-07/schema#"
+
+// jsonSchema is a JSON Schema document or subschema
+type jsonSchema map[string]interface{}
+
+// Schemas is the response data of a schema request. The schemas are
+// generated from the Go types the server marshals, so they always
+// match the wire format
+type Schemas struct {
+	Request  jsonSchema `json:"Request"`
+	Response jsonSchema `json:"Response"`
+	Pkg      jsonSchema `json:"Pkg"`
+	// Data of event responses pushed to subscribers
+	Event jsonSchema `json:"Event"`
+	// Data of ok responses keyed by request type. The data of
+	// error responses is the error message
+	Data map[string]jsonSchema `json:"Data"`
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaOf generates the schema of the JSON encoding of type t.
+// Pointers, slices and maps are nullable since encoding/json encodes
+// nil values as null
+func schemaOf(t reflect.Type) jsonSchema {
+	switch t {
+	case timeType:
+		return jsonSchema{"type": "string", "format": "date-time"}
+	case rawType:
+		return jsonSchema{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(schemaOf(t.Elem()))
+	case reflect.Slice, reflect.Array:
+		return jsonSchema{"type": []string{"array", "null"}, "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": []string{"object", "null"},
+			"additionalProperties": schemaOf(t.Elem())}
+	case reflect.Interface:
+		return jsonSchema{}
+	case reflect.Struct:
+		s := jsonSchema{"type": "object", "additionalProperties": false}
+		props := jsonSchema{}
+		required := []string{}
+		addFields(t, props, &required)
+		s["properties"] = props
+		s["required"] = required
+		return s
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	}
+	panic("no schema for type " + t.String())
+}
+
+// addFields adds the exported fields of struct type t to the
+// properties. Fields of embedded structs are promoted like
+// encoding/json does
+func addFields(t reflect.Type, props jsonSchema, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			addFields(ft, props, required)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		name := f.Name
+		if tag[0] != "" {
+			name = tag[0]
+		}
+		props[name] = schemaOf(f.Type)
+		if !stringInList(tag[1:], "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// nullable allows null in addition to the types of the schema
+func nullable(s jsonSchema) jsonSchema {
+	switch t := s["type"].(type) {
+	case string:
+		s["type"] = []string{t, "null"}
+	case []string:
+		if !stringInList(t, "null") {
+			s["type"] = append(t, "null")
+		}
+	}
+	return s
+}
+
+// pkgListSchema is the schema of filtered package lists: either
+// complete packages or the fields selected by the filter
+func pkgListSchema() jsonSchema {
+	projected := schemaOf(reflect.TypeOf(alpm.Pkg{}))
+	projected["required"] = []string{}
+	return jsonSchema{"type": []string{"array", "null"}, "items": jsonSchema{
+		"anyOf": []jsonSchema{schemaOf(reflect.TypeOf(alpm.Pkg{})), projected}}}
+}
+
+// buildSchemas generates the schemas of the protocol messages
+func (s *Server) buildSchemas() *Schemas {
+	document := func(name string, v interface{}) jsonSchema {
+		schema := schemaOf(reflect.TypeOf(v))
+		schema["$schema"] = SchemaDialect
+		schema["title"] = name
+		return schema
+	}
+	response := document("Response", Response{})
+	response["properties"].(jsonSchema)["ResponseType"] = jsonSchema{
+		"type": "string", "enum": []string{"ok", "error", "event", "heartbeat"}}
+
+	data := map[string]jsonSchema{
+		"hello":        schemaOf(reflect.TypeOf(&Capabilities{})),
+		"capabilities": schemaOf(reflect.TypeOf(&Capabilities{})),
+		"query":        schemaOf(reflect.TypeOf(map[string]*ServiceResult{})),
+		"subscribe":    {"type": "null"},
+		"status":       schemaOf(reflect.TypeOf(map[string]*ServiceStatus{})),
+		"job_status":   schemaOf(reflect.TypeOf(&SyncJob{})),
+		"changes":      schemaOf(reflect.TypeOf(&ChangesResult{})),
+		"stats":        schemaOf(reflect.TypeOf(&ServerStats{})),
+		"schema":       schemaOf(reflect.TypeOf(&Schemas{})),
+	}
+	for k, v := range s.services {
+		if _, ok := v.(syncRequester); ok {
+			data[k] = jsonSchema{"anyOf": []jsonSchema{
+				schemaOf(reflect.TypeOf(&SyncResult{})),
+				schemaOf(reflect.TypeOf(&SyncWaitResult{}))}}
+		} else if k == "sync" {
+			data[k] = jsonSchema{"type": "null"}
+		} else if _, ok := v.(*PreviewService); ok {
+			data[k] = jsonSchema{"anyOf": []jsonSchema{
+				schemaOf(reflect.TypeOf(&alpm.Preview{})),
+				schemaOf(reflect.TypeOf(&previewV1{}))}}
+		} else {
+			data[k] = pkgListSchema()
+		}
+	}
+	return &Schemas{document("Request", Request{}), response,
+		document("Pkg", alpm.Pkg{}), document("Event", UpdateEvent{}), data}
+}
+
+// schemaRequest returns the JSON Schemas of the protocol messages
+func (s *Server) schemaRequest(c *client, req *Request, version int) *Response {
+	return newResponse(version, s.buildSchemas())
+}
@@ -0,0 +1,226 @@
+package main
+
+import "bufio"
+import "encoding/json"
+import "fmt"
+import "math"
+import "net"
+import "sync"
+import "testing"
+import "time"
+import "pkgupd/alpm"
+
+// staticSyncService is a sync service that never syncs and knows
+// a single finished job. Its data are the results set by the test
+type staticSyncService struct {
+	staticService
+	results []*alpm.DBSyncResult
+}
+
+func (s *staticSyncService) GetData() (interface{}, error) {
+	return s.results, nil
+}
+
+func (s *staticSyncService) RequestSync() *SyncResult {
+	return &SyncResult{Status: SyncStarted, Job: 1}
+}
+
+func (s *staticSyncService) Job(id int) *SyncJob {
+	if id != 1 {
+		return nil
+	}
+	now := time.Now()
+	done := make(chan bool)
+	close(done)
+	return &SyncJob{ID: 1, State: JobFinished, Created: now, Finished: &now, done: done}
+}
+
+// validate checks the decoded JSON value v against the subset of
+// JSON Schema generated by schemaOf
+func validate(schema jsonSchema, v interface{}, path string) error {
+	if anyOf, ok := schema["anyOf"].([]jsonSchema); ok {
+		for _, sub := range anyOf {
+			if validate(sub, v, path) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %v matches no schema of anyOf", path, v)
+	}
+	var types []string
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []string:
+		types = t
+	case nil:
+		return nil
+	}
+	typeOf := func(v interface{}) string {
+		switch x := v.(type) {
+		case nil:
+			return "null"
+		case bool:
+			return "boolean"
+		case string:
+			return "string"
+		case float64:
+			if x == math.Trunc(x) && stringInList(types, "integer") {
+				return "integer"
+			}
+			return "number"
+		case []interface{}:
+			return "array"
+		case map[string]interface{}:
+			return "object"
+		}
+		return "unknown"
+	}
+	if !stringInList(types, typeOf(v)) {
+		return fmt.Errorf("%s: %v is not of type %v", path, v, types)
+	}
+	if enum, ok := schema["enum"].([]string); ok && !stringInList(enum, v.(string)) {
+		return fmt.Errorf("%s: %v is not one of %v", path, v, enum)
+	}
+	switch x := v.(type) {
+	case []interface{}:
+		for i, item := range x {
+			if err := validate(schema["items"].(jsonSchema), item,
+				fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		props, _ := schema["properties"].(jsonSchema)
+		if required, ok := schema["required"].([]string); ok {
+			for _, name := range required {
+				if _, ok := x[name]; !ok {
+					return fmt.Errorf("%s: missing property %s", path, name)
+				}
+			}
+		}
+		for name, value := range x {
+			sub, ok := props[name].(jsonSchema)
+			if !ok {
+				switch extra := schema["additionalProperties"].(type) {
+				case bool:
+					if !extra {
+						return fmt.Errorf("%s: unexpected property %s", path, name)
+					}
+					continue
+				case jsonSchema:
+					sub = extra
+				default:
+					continue
+				}
+			}
+			if err := validate(sub, value, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TestResponseSchemas sends every request type the server supports,
+// along with invalid requests, and validates all responses against
+// the schemas returned by the schema request
+func TestResponseSchemas(t *testing.T) {
+	server := NewServer(false)
+	repo := &staticService{mutex: &sync.Mutex{}}
+	repo.data = []*alpm.Pkg{{Name: "linux", LocalVersion: "4.7.1-1",
+		RemoteVersion: "4.7.2-1", Repo: "core", BuildDate: 100}}
+	server.AddService("repo", repo)
+	server.AddService("sync", &staticSyncService{staticService{mutex: &sync.Mutex{}}, nil})
+	preview := NewPreviewService(time.Hour, nil)
+	preview.preview = &alpm.Preview{Add: []*alpm.Pkg{{Name: "linux",
+		LocalVersion: "4.7.1-1", RemoteVersion: "4.7.2-1", Repo: "core"}},
+		Remove: []*alpm.Pkg{}, Problems: []*alpm.Problem{{Type: "conflict",
+			Package: "linux", Detail: "linux-lts"}}}
+	server.AddService("preview", preview)
+	conn, peer := net.Pipe()
+	server.acquireConn(conn)
+	go server.handleRequest(conn, nil)
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(peer)
+
+	roundTrip := func(line string) map[string]interface{} {
+		if _, err := peer.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		data, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v map[string]interface{}
+		if err = json.Unmarshal(data, &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	check := func(requestType string, resp map[string]interface{}) {
+		t.Helper()
+		schemas := server.buildSchemas()
+		if err := validate(schemas.Response, resp, requestType); err != nil {
+			t.Error(err)
+			return
+		}
+		switch resp["ResponseType"] {
+		case "ok":
+			data, ok := schemas.Data[requestType]
+			if !ok {
+				t.Errorf("no data schema for request type %s", requestType)
+				return
+			}
+			if err := validate(data, resp["Data"], requestType+".Data"); err != nil {
+				t.Error(err)
+			}
+		case "error":
+			if _, ok := resp["Data"].(string); !ok {
+				t.Errorf("%s: error data is not a message: %v", requestType, resp)
+			}
+		case "event":
+			if err := validate(schemas.Event, resp["Data"], requestType+".Event"); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	for _, requestType := range server.requestTypes(nil) {
+		if requestType == "subscribe" {
+			continue
+		}
+		check(requestType, roundTrip(`{"RequestType": "`+requestType+`"}`))
+		check(requestType, roundTrip(`{"RequestType": "`+requestType+`", "Version": 1}`))
+	}
+	requests := map[string][]string{
+		"repo": {`{"RequestType": "repo", "Filter": {"Fields": ["Name"]}}`,
+			`{"RequestType": "repo", "Filter": {"Regex": "("}}`},
+		"query": {`{"RequestType": "query", "Services": ["repo", "aur"]}`},
+		"sync":  {`{"RequestType": "sync", "Version": 3}`},
+		"job_status": {`{"RequestType": "job_status", "Job": 1}`,
+			`{"RequestType": "job_status", "Job": 2}`},
+		"changes": {`{"RequestType": "changes", "Since": 100}`},
+		"nope":    {`{"RequestType": "nope"}`, `{"RequestType": 1}`},
+	}
+	for requestType, lines := range requests {
+		for _, line := range lines {
+			check(requestType, roundTrip(line))
+		}
+	}
+
+	check("subscribe", roundTrip(`{"RequestType": "subscribe"}`))
+	repo.update(append(repo.data, &alpm.Pkg{Name: "firefox",
+		LocalVersion: "48.0-1", RemoteVersion: "49.0-1", Repo: "extra"}))
+	data, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evt map[string]interface{}
+	json.Unmarshal(data, &evt)
+	if evt["ResponseType"] != "event" {
+		t.Fatalf("expected an event, got %s", data)
+	}
+	check("subscribe", evt)
+}
@@ -1,49 +1,271 @@
 package main
 
 import "net"
+import "crypto/tls"
 import "bufio"
+import "bytes"
+import "io"
 
 import "os"
 import "fmt"
 import "time"
 import "sync"
-import "pkgupd/alpm"
 import "encoding/json"
 import "pkgupd/log"
+import "pkgupd/alpm"
 import "strings"
 import "errors"
+import "sort"
 import fsnotify "github.com/fsnotify/fsnotify"
 
 // Length of the maximum incoming request in bytes
 const MaxRequestLength = 16384
 
+// Time after which a write to a client is abandoned and the
+// connection is closed
+const WriteTimeout = 10 * time.Second
+
+// ProtocolVersion is the current version of the client protocol. It is
+// increased every time the wire format changes. Version 2 added error
+// codes and warnings
+const ProtocolVersion = 2
+
+// MinProtocolVersion is the oldest protocol version a client can still
+// pin in its requests
+const MinProtocolVersion = 1
+
+// Error codes of protocol errors
+const (
+	ErrInvalidRequest     = "invalid_request"
+	ErrMalformedRequest   = "malformed_request"
+	ErrRequestLength      = "request_too_long"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrUnknownService     = "unknown_service"
+	ErrInternal           = "internal_error"
+	ErrForbidden          = "forbidden"
+	ErrUnauthorized       = "unauthorized"
+	ErrUnknownJob         = "unknown_job"
+	ErrInvalidFilter      = "invalid_filter"
+	ErrExpiredToken       = "expired_token"
+	ErrTooManyConnections = "too_many_connections"
+)
+
 // Server is the basic structure that listens for client requests
 // and processes them. It also holds a list of enabled services
 type Server struct {
 	services    map[string]DataService
+	handlers    map[string]requestHandler
+	subscribers map[*client]bool
+	snapshots   *snapshotStore
+	subMutex    *sync.Mutex
 	closeMsg    chan bool
 	waitGroup   *sync.WaitGroup
 	serverError chan bool
 	fswatch     *FSWatchService
+	tlsConfig   *tls.Config
+	authToken   string
+	peerPolicy  PeerPolicy
+	socketMode  os.FileMode
+	socketGroup int
+	idleTimeout time.Duration
+	maxConns    int
+	stats       *ServerStats
+	statsMutex  *sync.Mutex
+	conns       map[net.Conn]bool
+	connGroup   *sync.WaitGroup
+	gracePeriod time.Duration
+	// Notified when the results of a service change
+	listeners []Listener
+}
+
+// ServerStats holds the connection counters of the server
+type ServerStats struct {
+	// Currently open connections
+	Connections int `json:"Connections"`
+	// Maximum number of concurrent connections, 0 if unlimited
+	MaxConnections int `json:"MaxConnections"`
+	// Connections rejected because the limit was reached
+	Rejected uint64 `json:"Rejected"`
+	// Connections closed because the client was idle
+	IdleTimeouts uint64 `json:"IdleTimeouts"`
+	// Requests rejected because they exceeded MaxRequestLength
+	Oversized uint64 `json:"Oversized"`
 }
 
+// errRequestTooLong is returned by readRequest for lines longer
+// than MaxRequestLength
+var errRequestTooLong = errors.New("request length exceeded")
+
 // Response struct is used when marshaling json responses
 // to the clients
 type Response struct {
 	ResponseType string      `json:"ResponseType"`
-	Data         []*alpm.Pkg `json:"Data"`
+	Version      int         `json:"Version"`
+	Data         interface{} `json:"Data"`
+	// Machine-readable error code of error responses
+	Code string `json:"Code,omitempty"`
+	// Errors of services that still returned (stale) data
+	Warnings []*ServiceError `json:"Warnings,omitempty"`
 }
 
 // Request struct is used to unmarshal json requests from
 // the clients
 type Request struct {
 	RequestType string `json:"RequestType"`
+	// Protocol version pinned by the client; 0 selects the
+	// current version
+	Version int `json:"Version,omitempty"`
+	// Services queried by a query request; empty means all
+	Services []string `json:"Services,omitempty"`
+	// Authentication token, required on TCP listeners if the
+	// server has a token
+	Token string `json:"Token,omitempty"`
+	// Wait for a sync to finish before responding
+	Wait bool `json:"Wait,omitempty"`
+	// Job id of a job_status request
+	Job int `json:"Job,omitempty"`
+	// Filter applied to the package lists of the response
+	Filter *PkgFilter `json:"Filter,omitempty"`
+	// Snapshot token of a changes request
+	Since uint64 `json:"Since,omitempty"`
+	// Framing used by the client after a hello request, jsonrpc
+	// switches to JSON-RPC 2.0
+	Protocol string `json:"Protocol,omitempty"`
+}
+
+// SyncWaitResult is the response data of a sync request with Wait
+// set. Updates holds the refreshed data of all other services.
+type SyncWaitResult struct {
+	*SyncResult
+	JobState *SyncJob                  `json:"JobState"`
+	Updates  map[string]*ServiceResult `json:"Updates"`
+}
+
+// ServiceResult is the per-service entry of a query response.
+// Status is either ok or error; in case of an error the message
+// is found in Error and the error code in Code
+type ServiceResult struct {
+	Status   string          `json:"Status"`
+	Code     string          `json:"Code,omitempty"`
+	Error    string          `json:"Error,omitempty"`
+	Warnings []*ServiceError `json:"Warnings,omitempty"`
+	Data     interface{}     `json:"Data"`
+}
+
+// Capabilities is the response data of a hello/capabilities
+// request
+type Capabilities struct {
+	// Current protocol version of the server
+	Version int `json:"Version"`
+	// Oldest protocol version that can be pinned
+	MinVersion int `json:"MinVersion"`
+	// Enabled services
+	Services []string `json:"Services"`
+	// Supported request types
+	Requests []string `json:"Requests"`
+	// Framings that can be selected besides the native one
+	Protocols []string `json:"Protocols"`
+}
+
+// requestHandler processes a decoded request from client c for which
+// the protocol version has already been negotiated
+type requestHandler func(c *client, req *Request, version int) *Response
+
+// client represents a connection to the server. Writes are serialized
+// so that pushed events do not interleave with responses
+type client struct {
+	conn   net.Conn
+	mutex  *sync.Mutex
+	policy *ListenerPolicy
+	// True if requests must carry the server token
+	auth bool
+	// Credentials of unix socket peers and the rules they are
+	// checked against
+	cred       *peerCred
+	peerPolicy PeerPolicy
+	// Event queue, version and services of a subscribed client
+	events   chan *Response
+	version  int
+	services []string
+	// True from a subscribe request until its reply is written and
+	// the events are forwarded
+	subscribing bool
+	// True once the client uses the JSON-RPC 2.0 framing
+	rpc bool
+}
+
+func newClient(conn net.Conn, policy *ListenerPolicy) *client {
+	return &client{conn: conn, mutex: &sync.Mutex{}, policy: policy}
+}
+
+// write marshals the response and sends it to the client followed
+// by a new line. If the write fails or times out the connection is
+// closed
+func (c *client) write(resp *Response) {
+	c.writeJSON(resp)
+}
+
+// writeJSON marshals v and sends it to the client followed by a new
+// line. If the write fails or times out the connection is closed
+func (c *client) writeJSON(v interface{}) {
+	respString, err := json.Marshal(v)
+	if err != nil {
+		c.writeError(ErrInternal, "could not marshal json")
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if _, err = c.conn.Write(append(respString, '\n')); err != nil {
+		log.Debugf("Write to %s failed: %s\n", c.conn.RemoteAddr(), err)
+		c.conn.Close()
+	}
+}
+
+// allows returns true if both the listener policy and the peer
+// policy allow the request type for this client
+func (c *client) allows(requestType string) bool {
+	return c.policy.Allows(requestType) &&
+		c.peerPolicy.Allows(requestType, c.cred)
+}
+
+// writeError sends an error response with the specified code
+// and message, as JSON-RPC error without id if the client uses the
+// JSON-RPC framing
+func (c *client) writeError(code string, msg string) {
+	if c.usesRPC() {
+		c.writeJSON(newRPCError(nil, code, msg))
+		return
+	}
+	c.write(newErrorResponse(ProtocolVersion, code, msg))
+}
+
+// writeEvent sends a pushed event, as JSON-RPC notification if the
+// client uses the JSON-RPC framing
+func (c *client) writeEvent(evt *Response) {
+	if c.usesRPC() {
+		c.writeJSON(&rpcNotification{"2.0", "event", evt.Data})
+		return
+	}
+	c.write(evt)
+}
+
+// setRPC switches the client to the JSON-RPC framing
+func (c *client) setRPC() {
+	c.mutex.Lock()
+	c.rpc = true
+	c.mutex.Unlock()
+}
+
+func (c *client) usesRPC() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.rpc
 }
 
 type deadliningListener interface {
+	net.Listener
 	SetDeadline(time.Time) error
-	Accept() (net.Conn, error)
-	Close() error
 }
 
 // NewServer creates a new server instance. Set the argument to true to also
@@ -63,8 +285,34 @@ func NewServer(notifyEnable bool) *Server {
 			log.Infoln("Enabling filesystem watcher")
 		}
 	}
-	s := &Server{make(map[string]DataService),
-		make(chan bool), &sync.WaitGroup{}, make(chan bool), watch}
+	s := &Server{
+		services:    make(map[string]DataService),
+		subscribers: make(map[*client]bool),
+		snapshots:   newSnapshotStore(),
+		subMutex:    &sync.Mutex{},
+		closeMsg:    make(chan bool),
+		waitGroup:   &sync.WaitGroup{},
+		serverError: make(chan bool),
+		fswatch:     watch,
+		socketMode:  0666,
+		socketGroup: -1,
+		stats:       &ServerStats{},
+		statsMutex:  &sync.Mutex{},
+		conns:       make(map[net.Conn]bool),
+		connGroup:   &sync.WaitGroup{},
+		gracePeriod: 10 * time.Second,
+	}
+	s.handlers = map[string]requestHandler{
+		"hello":        s.helloRequest,
+		"capabilities": s.helloRequest,
+		"query":        s.queryRequest,
+		"subscribe":    s.subscribeRequest,
+		"status":       s.statusRequest,
+		"job_status":   s.jobStatusRequest,
+		"changes":      s.changesRequest,
+		"stats":        s.statsRequest,
+		"schema":       s.schemaRequest,
+	}
 	return s
 }
 
@@ -72,6 +320,28 @@ func NewServer(notifyEnable bool) *Server {
 // The service must implement the DataService interface
 func (s *Server) AddService(key string, service DataService) {
 	s.services[key] = service
+	service.AddListener(&serviceWatcher{s, key})
+}
+
+// AddListener adds a listener that is notified with an
+// updates_changed;;SERVICE;;TOKEN event whenever the results of a
+// service change
+func (s *Server) AddListener(listener Listener) {
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// RemoveListener removes a listener added with Server.AddListener
+func (s *Server) RemoveListener(listener Listener) {
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	for i, l := range s.listeners {
+		if l == listener {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return
+		}
+	}
 }
 
 // RemoveService removes a service from the server with the specified key
@@ -96,18 +366,41 @@ func (s *Server) Start() {
 	}
 }
 
-// Stop stops the server. This stops the server immediately!
-// Use Server.Wait() before issuing this command
+// Stop stops accepting connections, disconnects idle clients and
+// signals the services to stop. Requests in progress are allowed
+// to finish; use Server.Wait() to wait for them
 func (s *Server) Stop() {
+	close(s.closeMsg)
+	// Wake up clients that are blocked waiting for a request
+	s.statsMutex.Lock()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.statsMutex.Unlock()
 	for _, service := range s.services {
 		service.Stop()
 	}
-	close(s.closeMsg)
 	if s.fswatch != nil {
 		s.fswatch.Stop()
 	}
 }
 
+// SetGracePeriod sets how long Server.Wait waits for requests in
+// progress before the remaining connections are closed
+func (s *Server) SetGracePeriod(grace time.Duration) {
+	s.gracePeriod = grace
+}
+
+// stopping returns true once the server has been stopped
+func (s *Server) stopping() bool {
+	select {
+	case <-s.closeMsg:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Server) createListener(proto string, addr string) (deadliningListener, error) {
 	proto = strings.ToLower(proto)
 	switch proto {
@@ -139,8 +432,13 @@ func (s *Server) createListener(proto string, addr string) (deadliningListener,
 			defer func() {
 				fi, er := os.Stat(addr)
 				if (er == nil) && (fi.Mode()&os.ModeSocket != 0) {
-					os.Chmod(addr, 0666)
+					os.Chmod(addr, s.socketMode)
 					log.Infoln("Changing permissions for socket")
+					if s.socketGroup >= 0 {
+						if er = os.Chown(addr, -1, s.socketGroup); er != nil {
+							log.Warnln("Could not change socket group:", er)
+						}
+					}
 				} else {
 					log.Infoln("Socket", addr, "created but is not a file")
 				}
@@ -151,104 +449,556 @@ func (s *Server) createListener(proto string, addr string) (deadliningListener,
 	return nil, errors.New("Invalid protocol specified")
 }
 
-// Serve starts serving clients to the configured address
-func (s *Server) Serve(proto string, addr string) {
-	s.waitGroup.Add(1)
-	defer s.waitGroup.Done()
+// Serve starts serving clients to the configured address. Requests
+// are restricted by the policy; a nil policy allows all requests
+func (s *Server) Serve(proto string, addr string, policy *ListenerPolicy) {
 	listener, err := s.createListener(proto, addr)
 	if err != nil {
 		log.Errorln("Failed to create listener:", err)
 		s.serverError <- true
 		return
 	}
-	s.serve(listener)
+	s.ServeListener(listener, policy)
 }
 
-// Wait blocks until all connections are flushed. Use this before
-// stopping the server
+// ServeListener starts serving clients on an already open listener,
+// for example a socket passed by systemd socket activation
+func (s *Server) ServeListener(listener deadliningListener, policy *ListenerPolicy) {
+	s.waitGroup.Add(1)
+	defer s.waitGroup.Done()
+	if s.tlsConfig != nil && listener.Addr().Network() == "tcp" {
+		log.Infoln("Enabling TLS for", listener.Addr())
+		listener = &tlsListener{listener, s.tlsConfig}
+	}
+	s.serve(listener, policy)
+}
+
+// Wait blocks until the listeners are closed and all connections
+// are flushed, then until the services have finished their current
+// run. Connections still open after the grace period are closed and
+// services still running are abandoned. Use this after stopping the
+// server
 func (s *Server) Wait() {
-	s.waitGroup.Wait()
+	deadline := time.Now().Add(s.gracePeriod)
+	done := make(chan bool)
+	go func() {
+		s.waitGroup.Wait()
+		s.connGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		log.Warnln("Grace period expired, closing remaining connections")
+		s.statsMutex.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.statsMutex.Unlock()
+		<-done
+	}
+	servicesDone := make(chan bool)
+	go func() {
+		for _, service := range s.services {
+			service.Wait()
+		}
+		close(servicesDone)
+	}()
+	select {
+	case <-servicesDone:
+	case <-time.After(time.Until(deadline)):
+		log.Warnln("Grace period expired, not waiting for the services")
+	}
 }
 
-func (s *Server) serve(listener deadliningListener) {
+func (s *Server) serve(listener deadliningListener, policy *ListenerPolicy) {
 	defer listener.Close()
 	for {
 		listener.SetDeadline(time.Now().Add(time.Second))
 		conn, err := listener.Accept()
-		select {
-		case <-s.closeMsg:
+		if s.stopping() {
+			if err == nil {
+				conn.Close()
+			}
 			return
-		default:
-			//nothing
 		}
 		if err != nil {
 			continue
 		}
-		go s.handleRequest(conn)
+		if !s.acquireConn(conn) {
+			log.Warnf("Too many connections, rejecting %s\n", conn.RemoteAddr())
+			go func() {
+				c := newClient(conn, policy)
+				c.writeError(ErrTooManyConnections, "too many connections")
+				conn.Close()
+			}()
+			continue
+		}
+		go s.handleRequest(conn, policy)
 	}
 }
 
-func (s *Server) errorResponse(conn net.Conn, msg string) {
-	conn.Write(append([]byte(fmt.Sprintf(`{"ResponseType": "error","Data": "%s"}`, msg)), '\n'))
+// SetConnectionLimits sets the time after which idle clients are
+// disconnected and the maximum number of concurrent connections.
+// Zero disables the respective limit
+func (s *Server) SetConnectionLimits(idle time.Duration, max int) {
+	s.idleTimeout = idle
+	s.maxConns = max
 }
 
-func (s *Server) handleRequest(conn net.Conn) {
-	defer conn.Close()
-	log.Debugf("Handling request from %s\n", conn.RemoteAddr())
-	bin := bufio.NewScanner(conn)
+// acquireConn reserves a connection slot and tracks the connection
+// until it is released. It returns false and counts the rejection
+// if the connection limit is reached
+func (s *Server) acquireConn(conn net.Conn) bool {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	if s.maxConns > 0 && len(s.conns) >= s.maxConns {
+		s.stats.Rejected++
+		return false
+	}
+	s.conns[conn] = true
+	s.connGroup.Add(1)
+	return true
+}
+
+// releaseConn frees the connection slot of conn
+func (s *Server) releaseConn(conn net.Conn) {
+	s.statsMutex.Lock()
+	delete(s.conns, conn)
+	s.statsMutex.Unlock()
+	s.connGroup.Done()
+}
+
+// count increments a counter of the server stats
+func (s *Server) count(counter *uint64) {
+	s.statsMutex.Lock()
+	*counter++
+	s.statsMutex.Unlock()
+}
+
+// statsRequest returns the connection counters of the server
+func (s *Server) statsRequest(c *client, req *Request, version int) *Response {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	stats := *s.stats
+	stats.Connections = len(s.conns)
+	stats.MaxConnections = s.maxConns
+	return newResponse(version, &stats)
+}
+
+// readRequest reads a line from the reader. Lines longer than
+// MaxRequestLength are discarded up to the next new line and
+// errRequestTooLong is returned instead
+func readRequest(r *bufio.Reader) ([]byte, error) {
 	var line []byte
-	totalRead := 0
-	for bin.Scan() {
-		line = bin.Bytes()
-		totalRead += len(line)
-		// Stop reading if request length is too big
-		if totalRead >= MaxRequestLength {
-			s.errorResponse(conn, "request length exceeded")
-			log.Debugf("Request from %s exceeded length %d\n",
-				conn.RemoteAddr(), MaxRequestLength)
-			break
+	tooLong := false
+	for {
+		frag, err := r.ReadSlice('\n')
+		if !tooLong && len(line)+len(frag) > MaxRequestLength+1 {
+			tooLong = true
+			line = nil
+		} else if !tooLong {
+			line = append(line, frag...)
 		}
-		if err := bin.Err(); err == nil {
-			var req Request
-			err = json.Unmarshal(line, &req)
-			var data []*alpm.Pkg
-			switch req.RequestType {
-			case "repo":
-				if v, ok := s.services["repo"]; ok {
-					data = v.GetData().([]*alpm.Pkg)
-				} else {
-					s.errorResponse(conn, "invalid request")
-					break
-				}
-			case "aur":
-				if v, ok := s.services["aur"]; ok {
-					data = v.GetData().([]*alpm.Pkg)
-				} else {
-					s.errorResponse(conn, "invalid request")
-					break
-				}
-			case "sync":
-				if v, ok := s.services["sync"]; ok {
-					v.SendMessage("force_sync")
-				} else {
-					s.errorResponse(conn, "invalid request")
-				}
-			default:
-				s.errorResponse(conn, "invalid request")
-				break
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (len(line) == 0 || err != io.EOF) {
+			return nil, err
+		}
+		break
+	}
+	if tooLong {
+		return nil, errRequestTooLong
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// newResponse creates a response of type ok for the negotiated
+// protocol version. Warnings are dropped for versions that do not
+// support them and the data is converted with dataForVersion
+func newResponse(version int, data interface{}, warnings ...*ServiceError) *Response {
+	resp := &Response{ResponseType: "ok", Version: version, Data: dataForVersion(version, data)}
+	if version >= 2 && len(warnings) != 0 {
+		resp.Warnings = warnings
+	}
+	return resp
+}
+
+// newErrorResponse creates a response of type error; the message
+// is carried in the Data field. The code is dropped for versions
+// that do not support it
+func newErrorResponse(version int, code string, msg string) *Response {
+	resp := &Response{ResponseType: "error", Version: version, Data: msg}
+	if version >= 2 {
+		resp.Code = code
+	}
+	return resp
+}
+
+// pkgV1 is a package in the format of protocol version 1, without
+// the details of the remote package
+type pkgV1 struct {
+	Name          string
+	LocalVersion  string
+	RemoteVersion string
+	Foreign       bool
+}
+
+// changeSetV1 is a ChangeSet with packages of protocol version 1
+type changeSetV1 struct {
+	Added   []*pkgV1 `json:"Added"`
+	Removed []*pkgV1 `json:"Removed"`
+	Changed []*pkgV1 `json:"Changed"`
+}
+
+// updateEventV1 is an UpdateEvent with packages of protocol version 1
+type updateEventV1 struct {
+	Service string `json:"Service"`
+	Token   uint64 `json:"Token,omitempty"`
+	*changeSetV1
+}
+
+// previewV1 is an alpm.Preview with packages of protocol version 1
+type previewV1 struct {
+	Add      []*pkgV1
+	Remove   []*pkgV1
+	Problems []*alpm.Problem
+}
+
+// pkgsV1 converts packages to the format of protocol version 1
+func pkgsV1(pkgs []*alpm.Pkg) []*pkgV1 {
+	if pkgs == nil {
+		return nil
+	}
+	ret := make([]*pkgV1, len(pkgs))
+	for i, p := range pkgs {
+		ret[i] = &pkgV1{p.Name, p.LocalVersion, p.RemoteVersion, p.Foreign}
+	}
+	return ret
+}
+
+// dataForVersion converts response data to the format of protocol
+// version 1 if the client pinned it: packages only have the fields
+// of version 1 and the sync service has no data. Projected package
+// fields are kept since the client selected them. Data of later
+// versions is returned unchanged
+func dataForVersion(version int, data interface{}) interface{} {
+	if version >= 2 {
+		return data
+	}
+	switch d := data.(type) {
+	case []*alpm.Pkg:
+		return pkgsV1(d)
+	case *ChangeSet:
+		if d == nil {
+			return nil
+		}
+		return &changeSetV1{pkgsV1(d.Added), pkgsV1(d.Removed), pkgsV1(d.Changed)}
+	case *UpdateEvent:
+		return &updateEventV1{d.Service, d.Token,
+			&changeSetV1{pkgsV1(d.Added), pkgsV1(d.Removed), pkgsV1(d.Changed)}}
+	case *alpm.Preview:
+		if d == nil {
+			return nil
+		}
+		return &previewV1{pkgsV1(d.Add), pkgsV1(d.Remove), d.Problems}
+	case *ChangesResult:
+		return &ChangesResult{d.Token,
+			dataForVersion(version, d.Changes).(map[string]*ServiceResult)}
+	case []*alpm.DBSyncResult:
+		return nil
+	case map[string]*ServiceResult:
+		ret := make(map[string]*ServiceResult, len(d))
+		for k, v := range d {
+			result := *v
+			result.Data = dataForVersion(version, v.Data)
+			ret[k] = &result
+		}
+		return ret
+	}
+	return data
+}
+
+// negotiateVersion returns the protocol version that will be used to
+// answer a request pinned at the specified version
+func negotiateVersion(version int) (int, error) {
+	if version == 0 {
+		return ProtocolVersion, nil
+	}
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return 0, fmt.Errorf("unsupported protocol version %d", version)
+	}
+	return version, nil
+}
+
+// requestTypes returns the request types currently supported by the
+// server, including the enabled services, that are allowed for the
+// client c. A nil client is allowed everything
+func (s *Server) requestTypes(c *client) []string {
+	var types []string
+	for k := range s.handlers {
+		if c == nil || c.allows(k) {
+			types = append(types, k)
+		}
+	}
+	for k := range s.services {
+		if c == nil || c.allows(k) {
+			types = append(types, k)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (s *Server) helloRequest(c *client, req *Request, version int) *Response {
+	switch req.Protocol {
+	case "":
+	case ProtocolJSONRPC:
+		// The response is still sent in the framing of the request
+		if c != nil {
+			defer c.setRPC()
+		}
+	default:
+		return newErrorResponse(version, ErrInvalidRequest,
+			"unsupported protocol "+req.Protocol)
+	}
+	var services []string
+	for k := range s.services {
+		services = append(services, k)
+	}
+	sort.Strings(services)
+	return newResponse(version, &Capabilities{ProtocolVersion,
+		MinProtocolVersion, services, s.requestTypes(c),
+		[]string{ProtocolJSONRPC}})
+}
+
+// statusRequest returns the run metadata of every service keyed
+// by service name
+func (s *Server) statusRequest(c *client, req *Request, version int) *Response {
+	status := make(map[string]*ServiceStatus)
+	for k, v := range s.services {
+		status[k] = v.GetStatus()
+	}
+	return newResponse(version, status)
+}
+
+// serviceData returns the current data of the service with the
+// specified key. If the last run of the service failed but an earlier
+// run succeeded the stale data is returned along with a warning. If
+// the service never succeeded the error is returned instead.
+func (s *Server) serviceData(key string) (interface{}, []*ServiceError, *ServiceError) {
+	v, ok := s.services[key]
+	if !ok {
+		return nil, nil, &ServiceError{ErrUnknownService, "unknown service " + key}
+	}
+	data, err := v.GetData()
+	if err == nil {
+		return data, nil, nil
+	}
+	serr := toServiceError(err)
+	if v.GetStatus().LastSuccess == nil {
+		return nil, nil, serr
+	}
+	return data, []*ServiceError{serr}, nil
+}
+
+// queryRequest answers for multiple services in a single response
+// keyed by service name. Errors are reported per service and never
+// fail the whole request
+func (s *Server) queryRequest(c *client, req *Request, version int) *Response {
+	keys := req.Services
+	if len(keys) == 0 {
+		for k := range s.services {
+			keys = append(keys, k)
+		}
+	}
+	return newResponse(version, s.queryResults(c, keys, req.Filter, version))
+}
+
+// queryResults collects the results of the services with the
+// specified keys for a query. Package lists are passed through
+// the filter
+func (s *Server) queryResults(c *client, keys []string, filter *PkgFilter,
+	version int) map[string]*ServiceResult {
+	results := make(map[string]*ServiceResult)
+	for _, k := range keys {
+		if c != nil && !c.allows(k) {
+			results[k] = &ServiceResult{Status: "error", Error: "not allowed"}
+			if version >= 2 {
+				results[k].Code = ErrForbidden
+			}
+			continue
+		}
+		data, warnings, err := s.serviceData(k)
+		if err != nil {
+			results[k] = &ServiceResult{Status: "error", Error: err.Message}
+			if version >= 2 {
+				results[k].Code = err.Code
 			}
-			resp := &Response{"ok", data}
-			respString, err := json.Marshal(resp)
-			if err != nil {
-				s.errorResponse(conn, "could not marshal json")
-			} else {
-				respString = append(respString, '\n')
-				conn.Write(respString)
+		} else {
+			results[k] = &ServiceResult{Status: "ok", Data: filter.apply(data)}
+			if version >= 2 {
+				results[k].Warnings = warnings
 			}
+		}
+	}
+	return results
+}
+
+// syncRequest forces a sync. If the request has Wait set the
+// response is sent once the sync and the dependent service updates
+// have finished and it includes the fresh data of all services.
+func (s *Server) syncRequest(c *client, req *Request, version int,
+	r syncRequester) *Response {
+	result := r.RequestSync()
+	// Version 1 has no sync jobs, the sync is only started
+	if version < 2 {
+		return newResponse(version, nil)
+	}
+	if !req.Wait || result.Job == 0 {
+		return newResponse(version, result)
+	}
+	job := r.Job(result.Job)
+	if job == nil {
+		return newErrorResponse(version, ErrUnknownJob, "sync job expired")
+	}
+	select {
+	case <-job.Done():
+	case <-s.closeMsg:
+		return newErrorResponse(version, ErrInternal, "server is shutting down")
+	}
+	var keys []string
+	for k := range s.services {
+		if k != req.RequestType {
+			keys = append(keys, k)
+		}
+	}
+	return newResponse(version, &SyncWaitResult{result, r.Job(result.Job),
+		s.queryResults(c, keys, req.Filter, version)})
+}
+
+// jobStatusRequest returns the state of a sync job
+func (s *Server) jobStatusRequest(c *client, req *Request, version int) *Response {
+	v, ok := s.services["sync"]
+	if !ok {
+		return newErrorResponse(version, ErrUnknownService, "sync service is not enabled")
+	}
+	r, ok := v.(syncRequester)
+	if !ok {
+		return newErrorResponse(version, ErrUnknownService, "sync service has no jobs")
+	}
+	job := r.Job(req.Job)
+	if job == nil {
+		return newErrorResponse(version, ErrUnknownJob, fmt.Sprintf("unknown job %d", req.Job))
+	}
+	return newResponse(version, job)
+}
+
+func (s *Server) serviceRequest(c *client, req *Request, version int) *Response {
+	v, ok := s.services[req.RequestType]
+	if !ok {
+		return newErrorResponse(version, ErrInvalidRequest, "invalid request")
+	}
+	if req.RequestType == "sync" {
+		if r, ok := v.(syncRequester); ok {
+			return s.syncRequest(c, req, version, r)
+		}
+		v.SendMessage("force_sync")
+		return newResponse(version, nil)
+	}
+	data, warnings, err := s.serviceData(req.RequestType)
+	if err != nil {
+		return newErrorResponse(version, err.Code, err.Message)
+	}
+	return newResponse(version, req.Filter.apply(data), warnings...)
+}
+
+// processRequest negotiates the protocol version and dispatches the
+// request to the appropriate handler
+func (s *Server) processRequest(c *client, req *Request) *Response {
+	version, err := negotiateVersion(req.Version)
+	if err != nil {
+		return newErrorResponse(ProtocolVersion, ErrUnsupportedVersion, err.Error())
+	}
+	if c != nil && c.auth && !s.authenticate(req) {
+		return newErrorResponse(version, ErrUnauthorized, "invalid or missing token")
+	}
+	if c != nil && !c.allows(req.RequestType) {
+		return newErrorResponse(version, ErrForbidden,
+			"request "+req.RequestType+" is not allowed on this listener")
+	}
+	if req.Filter != nil {
+		if err := req.Filter.compile(); err != nil {
+			return newErrorResponse(version, ErrInvalidFilter, err.Error())
+		}
+	}
+	if handler, ok := s.handlers[req.RequestType]; ok {
+		return handler(c, req, version)
+	}
+	return s.serviceRequest(c, req, version)
+}
+
+func (s *Server) handleRequest(conn net.Conn, policy *ListenerPolicy) {
+	defer s.releaseConn(conn)
+	defer conn.Close()
+	log.Debugf("Handling request from %s\n", conn.RemoteAddr())
+	c := newClient(conn, policy)
+	c.auth = s.authRequired(conn.LocalAddr())
+	c.peerPolicy = s.peerPolicy
+	if cred, err := getPeerCred(conn); err != nil {
+		log.Warnln("Could not read peer credentials:", err)
+		// treat the peer as unprivileged
+		c.cred = &peerCred{uid: ^uint32(0)}
+	} else {
+		c.cred = cred
+	}
+	defer s.unsubscribe(c)
+	bin := bufio.NewReader(conn)
+	for {
+		// Subscribed clients are expected to stay idle
+		if s.idleTimeout > 0 && c.events == nil {
+			conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
 		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		// Checked after the deadline is set so that Server.Stop
+		// can not be missed
+		if s.stopping() {
+			break
+		}
+		line, err := readRequest(bin)
+		if err == errRequestTooLong {
+			s.count(&s.stats.Oversized)
+			c.writeError(ErrRequestLength, "request length exceeded")
+			log.Debugf("Request from %s exceeded length %d\n",
+				conn.RemoteAddr(), MaxRequestLength)
+			continue
+		}
+		if err != nil && s.stopping() {
+			break
+		} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			s.count(&s.stats.IdleTimeouts)
+			log.Debugf("Connection from %s timed out\n", conn.RemoteAddr())
+			break
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
 			log.Warnln(err)
 			break
 		}
+		if c.usesRPC() || isRPC(line) {
+			s.handleRPC(c, line)
+			s.startSubscription(c)
+			continue
+		}
+		var req Request
+		if err := json.Unmarshal(line, &req); err != nil {
+			c.writeError(ErrMalformedRequest, "malformed request")
+			continue
+		}
+		c.write(s.processRequest(c, &req))
+		s.startSubscription(c)
 	}
 	log.Debugf("Connection from %s handled successfully\n", conn.RemoteAddr())
 }
@@ -0,0 +1,420 @@
+package main
+
+import "bufio"
+import "encoding/json"
+import "io"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "os"
+import "path"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+import "pkgupd/alpm"
+
+func TestReadRequest(t *testing.T) {
+	long := strings.Repeat("x", MaxRequestLength+1)
+	r := bufio.NewReaderSize(strings.NewReader(
+		"{}\n"+long+"\n{\"RequestType\": \"repo\"}\r\nlast"), 16)
+
+	expect := []string{"{}", "", "{\"RequestType\": \"repo\"}", "last"}
+	for i, e := range expect {
+		line, err := readRequest(r)
+		if i == 1 {
+			if err != errRequestTooLong {
+				t.Errorf("expected errRequestTooLong, got %v", err)
+			}
+			continue
+		}
+		if err != nil || string(line) != e {
+			t.Errorf("line %d: got %q, %v, want %q", i, line, err, e)
+		}
+	}
+	if _, err := readRequest(r); err == nil {
+		t.Error("expected an error at the end of input")
+	}
+}
+
+func TestSubscribePolicy(t *testing.T) {
+	server := NewServer(false)
+	repo := &staticService{mutex: &sync.Mutex{}}
+	aur := &staticService{mutex: &sync.Mutex{}}
+	server.AddService("repo", repo)
+	server.AddService("aur", aur)
+	conn, peer := net.Pipe()
+	server.acquireConn(conn)
+	go server.handleRequest(conn, &ListenerPolicy{Deny: []string{"aur"}})
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(peer)
+	request := func(line string) *Response {
+		t.Helper()
+		if _, err := peer.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		resp := &Response{}
+		line, err := r.ReadString('\n')
+		if err == nil {
+			err = json.Unmarshal([]byte(line), resp)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := request(`{"RequestType": "subscribe", "Services": ["aur"]}`); resp.Code != ErrForbidden {
+		t.Fatalf("expected a forbidden subscription, got %+v", resp)
+	}
+	if resp := request(`{"RequestType": "subscribe"}`); resp.ResponseType != "ok" {
+		t.Fatalf("unexpected subscribe response %+v", resp)
+	}
+
+	// a subscription to all services gets no events of denied services
+	aur.update([]*alpm.Pkg{{Name: "yaourt", LocalVersion: "1.8-1", RemoteVersion: "1.9-1"}})
+	repo.update([]*alpm.Pkg{{Name: "linux", LocalVersion: "4.7.1-1", RemoteVersion: "4.7.2-1"}})
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evt struct {
+		ResponseType string
+		Data         UpdateEvent
+	}
+	if err = json.Unmarshal([]byte(line), &evt); err != nil {
+		t.Fatal(err)
+	}
+	if evt.ResponseType != "event" || evt.Data.Service != "repo" {
+		t.Errorf("expected only the repo event, got %s", line)
+	}
+}
+
+func TestSubscribeAfterReply(t *testing.T) {
+	server := NewServer(false)
+	repo := &staticService{mutex: &sync.Mutex{}}
+	server.AddService("repo", repo)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	c := newClient(conn, nil)
+	defer server.unsubscribe(c)
+
+	// events published before the reply is written are queued
+	if resp := server.subscribeRequest(c, &Request{RequestType: "subscribe"}, ProtocolVersion); resp.ResponseType != "ok" {
+		t.Fatalf("unexpected subscribe response %+v", resp)
+	}
+	repo.update([]*alpm.Pkg{{Name: "linux", LocalVersion: "4.7.1-1", RemoteVersion: "4.7.2-1"}})
+	if len(c.events) != 1 {
+		t.Fatalf("expected a queued event, got %d", len(c.events))
+	}
+	go func() {
+		c.write(newResponse(ProtocolVersion, nil))
+		server.startSubscription(c)
+	}()
+	r := bufio.NewReader(peer)
+	for _, expected := range []string{"ok", "event"} {
+		resp := readResponse(t, r)
+		if resp.ResponseType != expected {
+			t.Errorf("expected %s, got %+v", expected, resp)
+		}
+	}
+}
+
+func TestVersion1Responses(t *testing.T) {
+	server := NewServer(false)
+	syncService := &staticSyncService{staticService{mutex: &sync.Mutex{}}, nil}
+	server.AddService("sync", syncService)
+	conn, peer := net.Pipe()
+	server.acquireConn(conn)
+	go server.handleRequest(conn, nil)
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(peer)
+	request := func(line string) string {
+		t.Helper()
+		if _, err := peer.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(resp)
+	}
+
+	// clients pinned to version 1 get the responses they got before
+	// syncs had jobs and results
+	expect := [][2]string{
+		{`{"RequestType": "sync", "Version": 1}`,
+			`{"ResponseType":"ok","Version":1,"Data":null}`},
+		{`{"RequestType": "sync", "Version": 1, "Wait": true}`,
+			`{"ResponseType":"ok","Version":1,"Data":null}`},
+		{`{"RequestType": "query", "Version": 1, "Services": ["sync"]}`,
+			`{"ResponseType":"ok","Version":1,"Data":{"sync":{"Status":"ok","Data":null}}}`},
+		{`{"RequestType": "sync"}`,
+			`{"ResponseType":"ok","Version":2,"Data":{"Status":"started","Job":1}}`},
+	}
+	syncService.results = []*alpm.DBSyncResult{{Name: "core", State: alpm.DBUpdated}}
+	for _, e := range expect {
+		if resp := request(e[0]); resp != e[1] {
+			t.Errorf("%s: expected %s, got %s", e[0], e[1], resp)
+		}
+	}
+
+	// and packages without the details of the remote package
+	repo := &staticService{mutex: &sync.Mutex{}}
+	repo.data = []*alpm.Pkg{{Name: "linux", LocalVersion: "4.7.1-1",
+		RemoteVersion: "4.7.2-1", Repo: "core", Groups: []string{"base"}}}
+	server.AddService("repo", repo)
+	v1Pkgs := `[{"Name":"linux","LocalVersion":"4.7.1-1","RemoteVersion":"4.7.2-1","Foreign":false}]`
+	expect = [][2]string{
+		{`{"RequestType": "repo", "Version": 1}`,
+			`{"ResponseType":"ok","Version":1,"Data":` + v1Pkgs + `}`},
+		{`{"RequestType": "query", "Version": 1, "Services": ["repo"]}`,
+			`{"ResponseType":"ok","Version":1,"Data":{"repo":{"Status":"ok","Data":` + v1Pkgs + `}}}`},
+		{`{"RequestType": "repo", "Version": 1, "Filter": {"Fields": ["Name", "Repo"]}}`,
+			`{"ResponseType":"ok","Version":1,"Data":[{"Name":"linux","Repo":"core"}]}`},
+		{`{"RequestType": "subscribe", "Version": 1}`,
+			`{"ResponseType":"ok","Version":1,"Data":null}`},
+	}
+	for _, e := range expect {
+		if resp := request(e[0]); resp != e[1] {
+			t.Errorf("%s: expected %s, got %s", e[0], e[1], resp)
+		}
+	}
+	repo.update(append(repo.data, &alpm.Pkg{Name: "firefox", LocalVersion: "48.0-1",
+		RemoteVersion: "49.0-1", Repo: "extra"}))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := `{"ResponseType":"event","Version":1,"Data":{"Service":"repo","Token":1,"Added":` +
+		`[{"Name":"linux","LocalVersion":"4.7.1-1","RemoteVersion":"4.7.2-1","Foreign":false},` +
+		`{"Name":"firefox","LocalVersion":"48.0-1","RemoteVersion":"49.0-1","Foreign":false}],` +
+		`"Removed":null,"Changed":null}}`
+	if strings.TrimSpace(line) != e {
+		t.Errorf("expected event %s, got %s", e, line)
+	}
+}
+
+// listenUnix returns a listener on a socket in a temporary directory
+// and a function that removes the directory
+func listenUnix(t *testing.T) (*net.UnixListener, func()) {
+	dir, err := ioutil.TempDir("", "pkgupd-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path.Join(dir, "sock"), Net: "unix"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return l, func() { os.RemoveAll(dir) }
+}
+
+// dialRequest connects to the listener and sends the request lines
+func dialRequest(t *testing.T, l net.Listener, lines ...string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range lines {
+		if _, err = conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func readResponse(t *testing.T, r *bufio.Reader) *Response {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &Response{}
+	if err = json.Unmarshal([]byte(line), resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestConnectionLimits(t *testing.T) {
+	server := NewServer(false)
+	idle := 300 * time.Millisecond
+	server.SetConnectionLimits(idle, 1)
+	l, cleanup := listenUnix(t)
+	defer cleanup()
+	go server.ServeListener(l, nil)
+	defer server.Stop()
+
+	first, r := dialRequest(t, l, `{"RequestType": "stats"}`)
+	defer first.Close()
+	start := time.Now()
+	if resp := readResponse(t, r); resp.ResponseType != "ok" {
+		t.Fatalf("unexpected stats response %+v", resp)
+	}
+
+	// connections over the limit get an error and are closed
+	second, r2 := dialRequest(t, l)
+	defer second.Close()
+	if resp := readResponse(t, r2); resp.Code != ErrTooManyConnections {
+		t.Errorf("expected a too_many_connections error, got %+v", resp)
+	}
+	if _, err := r2.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the rejected connection to be closed, got %v", err)
+	}
+
+	// the first connection is closed once it was idle for long enough
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < idle {
+		t.Errorf("idle connection closed after %s", elapsed)
+	}
+	server.statsMutex.Lock()
+	stats := *server.stats
+	server.statsMutex.Unlock()
+	if stats.Rejected != 1 || stats.IdleTimeouts != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestAPIConnectionLimit(t *testing.T) {
+	server := NewServer(false)
+	server.SetConnectionLimits(0, 1)
+	l, cleanup := listenUnix(t)
+	defer cleanup()
+	go server.ServeAPIListener(l, nil)
+	defer server.Stop()
+
+	// an idle client holds the only connection slot
+	first, _ := dialRequest(t, l)
+	defer first.Close()
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) {
+			return net.Dial("unix", l.Addr().String())
+		}}, Timeout: 5 * time.Second}
+	resp, err := client.Get("http://pkgupd" + APIPrefix + "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := &Response{}
+	if err = json.NewDecoder(resp.Body).Decode(body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Code != ErrTooManyConnections {
+		t.Errorf("expected a too_many_connections error, got %d %+v", resp.StatusCode, body)
+	}
+}
+
+func TestAPIListenerPolicy(t *testing.T) {
+	server := NewServer(false)
+	server.AddService("sync", &staticSyncService{staticService{mutex: &sync.Mutex{}}, nil})
+	l, cleanup := listenUnix(t)
+	defer cleanup()
+	go server.ServeAPIListener(l, &ListenerPolicy{Deny: writeRequestTypes})
+	defer server.Stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) {
+			return net.Dial("unix", l.Addr().String())
+		}}, Timeout: 5 * time.Second}
+	resp, err := client.Post("http://pkgupd"+APIPrefix+"sync", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the sync to be forbidden on a readonly listener, got %s", resp.Status)
+	}
+	resp, err = client.Get("http://pkgupd" + APIPrefix + "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected stats to be allowed, got %s", resp.Status)
+	}
+}
+
+// blockingService blocks GetData until release is closed
+type blockingService struct {
+	staticService
+	entered chan bool
+	release chan bool
+}
+
+func (s *blockingService) GetData() (interface{}, error) {
+	s.entered <- true
+	<-s.release
+	return s.staticService.GetData()
+}
+
+func TestStopDrainsRequests(t *testing.T) {
+	server := NewServer(false)
+	repo := &blockingService{staticService{mutex: &sync.Mutex{}},
+		make(chan bool, 1), make(chan bool)}
+	server.AddService("repo", repo)
+	l, cleanup := listenUnix(t)
+	defer cleanup()
+	go server.ServeListener(l, nil)
+
+	conn, r := dialRequest(t, l, `{"RequestType": "repo"}`)
+	defer conn.Close()
+	<-repo.entered
+	server.Stop()
+	waited := make(chan bool)
+	go func() {
+		server.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned before the request finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the request in progress is answered, then the connection closed
+	close(repo.release)
+	if resp := readResponse(t, r); resp.ResponseType != "ok" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Error("Wait did not return after the request finished")
+	}
+}
+
+// stuckService never finishes its current run
+type stuckService struct {
+	staticService
+}
+
+func (s *stuckService) Wait() {
+	select {}
+}
+
+func TestWaitGracePeriod(t *testing.T) {
+	server := NewServer(false)
+	server.AddService("repo", &stuckService{staticService{mutex: &sync.Mutex{}}})
+	server.SetGracePeriod(100 * time.Millisecond)
+	server.Stop()
+	waited := make(chan bool)
+	go func() {
+		server.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Error("Wait did not return after the grace period")
+	}
+}
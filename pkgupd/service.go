@@ -12,9 +12,43 @@ import "strings"
 import "path"
 import fsnotify "github.com/fsnotify/fsnotify"
 
-type executeCB func(args ...string)
+type executeCB func(args ...string) error
 type msgProcessor func(string)
 
+// Error codes of ServiceError
+const (
+	// Unspecified service error
+	ErrService = "service_error"
+	// The AUR could not be queried
+	ErrAUR = "aur_error"
+	// The local or the sync databases could not be read
+	ErrDatabase = "database_error"
+	// The databases could not be synchronized
+	ErrSync = "sync_error"
+	// The system upgrade could not be previewed
+	ErrPreview = "preview_error"
+)
+
+// ServiceError is an error of a service run that is reported to
+// clients. Code is one of the machine-readable error codes
+type ServiceError struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+func (e *ServiceError) Error() string {
+	return e.Message
+}
+
+// toServiceError converts err to a ServiceError; errors that are not
+// already a ServiceError get the generic ErrService code
+func toServiceError(err error) *ServiceError {
+	if serr, ok := err.(*ServiceError); ok {
+		return serr
+	}
+	return &ServiceError{ErrService, err.Error()}
+}
+
 // Listener is an interface that should be implemented
 // by all types that expect to read events from services.
 // Events are string messages with fields seperated by
@@ -33,8 +67,11 @@ type Service interface {
 	Listener
 	// Start starts the service (usually as goroutine)
 	Start()
-	// Stop stops the services
+	// Stop signals the service to stop without waiting for
+	// it. A run in progress is allowed to finish
 	Stop()
+	// Wait blocks until a stopped service has finished
+	Wait()
 	// AddListener subscribes a type to receive events from
 	// this service
 	AddListener(listener Listener)
@@ -44,8 +81,31 @@ type Service interface {
 // data and message passing
 type DataService interface {
 	Service
-	GetData() interface{}
+	// GetData returns the data of the last successful run and the
+	// error of the last run if it failed
+	GetData() (interface{}, error)
 	SendMessage(string)
+	// GetStatus returns the run metadata of the service
+	GetStatus() *ServiceStatus
+}
+
+// ServiceStatus holds the run metadata of a service. Times are nil
+// if the corresponding event has not happened yet
+type ServiceStatus struct {
+	// Start of the last run
+	LastStart *time.Time `json:"LastStart"`
+	// End of the last run
+	LastEnd *time.Time `json:"LastEnd"`
+	// End of the last successful run
+	LastSuccess *time.Time `json:"LastSuccess"`
+	// Duration of the last run in seconds
+	Duration float64 `json:"Duration"`
+	// Error of the last run, empty if it succeeded
+	LastError string `json:"LastError"`
+	// Next scheduled run
+	NextRun *time.Time `json:"NextRun"`
+	// True if a run is in progress
+	Running bool `json:"Running"`
 }
 
 // FSWatchService implements the Service interface and
@@ -119,6 +179,12 @@ func (s *FSWatchService) Stop() {
 	}
 }
 
+// Wait implements the Wait method of the Service interface. The
+// watch service has already stopped once Stop returns
+func (s *FSWatchService) Wait() {
+	s.wg.Wait()
+}
+
 func (s *FSWatchService) notifyListeners(msg string) {
 	for _, l := range s.listeners {
 		l.ProcessEvent("fs_event;;" + msg)
@@ -147,7 +213,7 @@ func (s *FSWatchService) eventType(evt *fsnotify.Event) (string, error) {
 // Implements DataService
 type TimeoutService struct {
 	Timeout      time.Duration
-	libalpm      *alpm.Alpm
+	backend      alpm.Backend
 	mutex        *sync.Mutex
 	msgChannel   chan string
 	running      bool
@@ -155,36 +221,122 @@ type TimeoutService struct {
 	msgProcessor msgProcessor
 	listeners    []Listener
 	conf         map[string]map[string]interface{}
+	status       ServiceStatus
+	lastErr      *ServiceError
+	statusMutex  *sync.Mutex
+	// Closed by Stop and when the service loop exits
+	quit     chan bool
+	done     chan bool
+	stopOnce *sync.Once
+}
+
+// newTimeoutService creates the common part of the timeout services
+func newTimeoutService(timeout time.Duration, backend alpm.Backend) *TimeoutService {
+	return &TimeoutService{Timeout: timeout, backend: backend, mutex: &sync.Mutex{},
+		statusMutex: &sync.Mutex{}, msgChannel: make(chan string), running: false,
+		quit: make(chan bool), done: make(chan bool), stopOnce: &sync.Once{}}
 }
 
 // Start starts the timeout service
 func (s *TimeoutService) Start() {
-	if !s.running {
-		s.running = true
-		s.executor()
+	s.statusMutex.Lock()
+	started := s.running
+	s.running = true
+	s.statusMutex.Unlock()
+	if !started {
+		defer close(s.done)
+		if !s.stopped() {
+			s.run()
+		}
 	serviceLoop:
 		for {
+			next := time.Now().Add(s.Timeout)
+			s.statusMutex.Lock()
+			s.status.NextRun = &next
+			s.statusMutex.Unlock()
 			select {
+			case <-s.quit:
+				break serviceLoop
 			case val := <-s.msgChannel:
-				if val == "quit" {
-					s.running = false
-					break serviceLoop
-				} else {
-					s.msgProcessor(val)
-				}
+				s.msgProcessor(val)
 			case <-time.After(s.Timeout):
-				s.executor()
+				s.run()
 			}
 		}
 	}
 }
 
-// Stop stops the timeout service
+// Stop signals the timeout service to stop. It does not wait for
+// a run in progress; use TimeoutService.Wait for that
 func (s *TimeoutService) Stop() {
-	if s.running {
-		s.msgChannel <- "quit"
+	s.stopOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+// Wait blocks until the service loop of a started service has
+// exited, including a run that was in progress when it was stopped
+func (s *TimeoutService) Wait() {
+	s.statusMutex.Lock()
+	started := s.running
+	s.statusMutex.Unlock()
+	if started {
+		<-s.done
 	}
-	s.running = false
+}
+
+// stopped returns true once the service has been stopped
+func (s *TimeoutService) stopped() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// run calls the executor callback and records its run metadata
+func (s *TimeoutService) run(args ...string) {
+	start := time.Now()
+	s.statusMutex.Lock()
+	s.status.LastStart = &start
+	s.status.Running = true
+	s.statusMutex.Unlock()
+	err := s.executor(args...)
+	end := time.Now()
+	s.statusMutex.Lock()
+	s.status.LastEnd = &end
+	s.status.Duration = end.Sub(start).Seconds()
+	s.status.Running = false
+	if err != nil {
+		log.Errorln("Service run failed:", err)
+		s.lastErr = toServiceError(err)
+		s.status.LastError = err.Error()
+	} else {
+		s.lastErr = nil
+		s.status.LastError = ""
+		s.status.LastSuccess = &end
+	}
+	s.statusMutex.Unlock()
+}
+
+// lastError returns the error of the last run or nil if the last
+// run succeeded
+func (s *TimeoutService) lastError() error {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	if s.lastErr == nil {
+		return nil
+	}
+	return s.lastErr
+}
+
+// GetStatus returns a copy of the run metadata of the service
+func (s *TimeoutService) GetStatus() *ServiceStatus {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	status := s.status
+	return &status
 }
 
 func (s *TimeoutService) setExecuteCB(cb executeCB) {
@@ -196,14 +348,14 @@ func (s *TimeoutService) setMsgProcessorCB(cb msgProcessor) {
 }
 
 // SendMessage sends a message to the timeout service that is
-// processed from the msgProcessor callback. Message "quit" is
-// reserved and always break the service main loop so it cannot
-// be passed to the service. If you want to stop the service
+// processed from the msgProcessor callback. Messages sent to a
+// stopped service are dropped. If you want to stop the service
 // use TimeoutService.Stop()
 func (s *TimeoutService) SendMessage(msg string) {
-	// quit is a reserved message
-	if msg != "quit" {
-		s.msgChannel <- msg
+	select {
+	case s.msgChannel <- msg:
+	case <-s.quit:
+		log.Debugln("Service stopped, dropping message", msg)
 	}
 }
 
@@ -214,35 +366,126 @@ func (s *TimeoutService) AddListener(listener Listener) {
 }
 
 // ProcessEvent calls the message processor callback on the
-// specified message
+// specified message, unless the service has been stopped
 func (s *TimeoutService) ProcessEvent(msg string) {
-	s.msgProcessor(msg)
+	if !s.stopped() {
+		s.msgProcessor(msg)
+	}
+}
+
+func (s *TimeoutService) notifyListeners(msg string) {
+	for _, v := range s.listeners {
+		v.ProcessEvent(msg)
+	}
 }
 
 // SyncService is a timeout service that syncs
 // pacman databases
 type SyncService struct {
 	*TimeoutService
+	// Minimum interval between two forced syncs requested
+	// by clients
+	MinForceInterval time.Duration
+	forceMutex       *sync.Mutex
+	forcePending     bool
+	lastForced       time.Time
+	jobs             map[int]*SyncJob
+	currentJob       *SyncJob
+	lastJobID        int
+	// Results of the last sync, guarded by the status mutex
+	results []*alpm.DBSyncResult
+}
+
+// Number of finished sync jobs remembered for job status requests
+const MaxSyncJobs = 64
+
+// States of a SyncJob
+const (
+	JobPending  = "pending"
+	JobRunning  = "running"
+	JobFinished = "finished"
+	JobFailed   = "failed"
+)
+
+// SyncJob is a forced sync requested by one or more clients. A job
+// is done when the sync and the updates of the services that depend
+// on it have finished
+type SyncJob struct {
+	ID       int        `json:"ID"`
+	State    string     `json:"State"`
+	Error    string     `json:"Error,omitempty"`
+	Created  time.Time  `json:"Created"`
+	Finished *time.Time `json:"Finished"`
+	done     chan bool
+}
+
+// Done returns a channel that is closed when the job is done
+func (j *SyncJob) Done() <-chan bool {
+	return j.done
+}
+
+// Status values of SyncResult
+const (
+	// The request started a new forced sync
+	SyncStarted = "started"
+	// The request joined a forced sync that is already pending
+	SyncJoined = "joined"
+	// The request was rejected because the last forced sync
+	// was too recent
+	SyncThrottled = "throttled"
+)
+
+// SyncResult is returned to clients that request a sync
+type SyncResult struct {
+	Status string `json:"Status"`
+	// ID of the started or joined job
+	Job int `json:"Job,omitempty"`
+	// Seconds until a new forced sync is allowed, only set
+	// if the request was throttled
+	RetryAfter float64 `json:"RetryAfter,omitempty"`
+}
+
+// syncRequester is implemented by services that synchronize on
+// behalf of clients
+type syncRequester interface {
+	RequestSync() *SyncResult
+	// Job returns a copy of the job with the specified id or
+	// nil if the job is unknown
+	Job(id int) *SyncJob
 }
 
 // The executor callback
-func (s *SyncService) syncExecuteCB(args ...string) {
+func (s *SyncService) syncExecuteCB(args ...string) error {
 
 	force := stringInList(args, "force")
 
 	log.Infof("Execute Database Service Update\n")
 	s.mutex.Lock()
-	s.libalpm.Mutex.Lock()
-	didSync := s.libalpm.SyncDBs(force)
-	s.libalpm.Mutex.Unlock()
+	s.backend.Lock()
+	results, err := s.backend.SyncDBs(force)
+	s.backend.Unlock()
 	s.mutex.Unlock()
-	if didSync {
+	if results != nil {
+		s.statusMutex.Lock()
+		s.results = results
+		s.statusMutex.Unlock()
+	}
+	for _, r := range results {
+		log.Debugf("Database %s: %s %s\n", r.Name, r.State, r.Error)
+	}
+	// Databases that were updated before another one failed are
+	// still reported
+	if alpm.DBsUpdated(results) {
 		log.Debugln("Databases changed, notifying listeners")
 		s.notifyListeners("sync_finished")
 	} else {
 		log.Debugln("Database not changed, no need to notify listeners")
 	}
+	if err != nil {
+		return &ServiceError{ErrSync, err.Error()}
+	}
 	log.Infoln("Database update finished")
+	return nil
 }
 
 // The message processor callback
@@ -250,46 +493,137 @@ func (s *SyncService) processMsg(msg string) {
 	tmsg := strings.Split(msg, ";;")
 	switch tmsg[0] {
 	case "force_sync":
-		s.syncExecuteCB("force")
+		s.forceMutex.Lock()
+		job := s.currentJob
+		if job != nil {
+			job.State = JobRunning
+		}
+		s.forceMutex.Unlock()
+		s.run("force")
+		s.forceMutex.Lock()
+		s.forcePending = false
+		s.currentJob = nil
+		if job != nil {
+			now := time.Now()
+			job.Finished = &now
+			job.State = JobFinished
+			if err := s.lastError(); err != nil {
+				job.State = JobFailed
+				job.Error = err.Error()
+			}
+			close(job.done)
+		}
+		s.forceMutex.Unlock()
 	default:
 		return
 	}
 }
 
-func (s *SyncService) notifyListeners(msg string) {
-	for _, v := range s.listeners {
-		v.ProcessEvent(msg)
+// RequestSync requests a forced sync on behalf of a client without
+// blocking. Concurrent requests are coalesced into a single run and
+// forced syncs are limited to one per MinForceInterval.
+func (s *SyncService) RequestSync() *SyncResult {
+	s.forceMutex.Lock()
+	defer s.forceMutex.Unlock()
+	if s.forcePending {
+		return &SyncResult{Status: SyncJoined, Job: s.currentJob.ID}
+	}
+	if wait := s.MinForceInterval - time.Since(s.lastForced); wait > 0 {
+		return &SyncResult{Status: SyncThrottled, RetryAfter: wait.Seconds()}
+	}
+	s.forcePending = true
+	s.lastForced = time.Now()
+	s.lastJobID++
+	s.currentJob = &SyncJob{ID: s.lastJobID, State: JobPending,
+		Created: s.lastForced, done: make(chan bool)}
+	s.jobs[s.lastJobID] = s.currentJob
+	delete(s.jobs, s.lastJobID-MaxSyncJobs)
+	go s.SendMessage("force_sync")
+	return &SyncResult{Status: SyncStarted, Job: s.lastJobID}
+}
+
+// Job returns a copy of the sync job with the specified id or nil
+// if there is no such job
+func (s *SyncService) Job(id int) *SyncJob {
+	s.forceMutex.Lock()
+	defer s.forceMutex.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil
 	}
+	ret := *job
+	return &ret
 }
 
-// GetData always returns nil for SyncService
-func (s *SyncService) GetData() interface{} {
-	return nil
+// GetData returns the results of the databases in the last sync
+// as []*alpm.DBSyncResult, even if some of them failed, along with
+// the error of the last sync, if any
+func (s *SyncService) GetData() (interface{}, error) {
+	s.statusMutex.Lock()
+	results := s.results
+	s.statusMutex.Unlock()
+	return results, s.lastError()
+}
+
+// pkgList is the package list of a service. The executor builds a
+// new list and swaps it in so that readers never see a partial list
+type pkgList struct {
+	packages  *list.List
+	listMutex *sync.Mutex
+}
+
+func newPkgList() *pkgList {
+	return &pkgList{list.New(), &sync.Mutex{}}
+}
+
+// setPackages replaces the package list
+func (l *pkgList) setPackages(packages *list.List) {
+	l.listMutex.Lock()
+	l.packages = packages
+	l.listMutex.Unlock()
+}
+
+// packageSlice returns the packages of the list as []*alpm.Pkg
+func (l *pkgList) packageSlice() []*alpm.Pkg {
+	l.listMutex.Lock()
+	defer l.listMutex.Unlock()
+	var pkgs []*alpm.Pkg
+	for e := l.packages.Front(); e != nil; e = e.Next() {
+		pkgs = append(pkgs, e.Value.(*alpm.Pkg))
+	}
+	return pkgs
 }
 
 // RepoService is a timeout service that retrieves
 // local package updates from the pacman database
 type RepoService struct {
 	*TimeoutService
-	packages            *list.List
+	*pkgList
 	ignoredPackageNames []string
 	dbChanged           bool
 }
 
 // The executor callback
-func (s *RepoService) repoExecuteCB(args ...string) {
+func (s *RepoService) repoExecuteCB(args ...string) error {
 	log.Infoln("Execute Repo Service Update")
 	s.mutex.Lock()
-	s.packages = s.packages.Init()
-	updPkgs := s.libalpm.GetUpdates()
+	updPkgs, err := s.backend.GetUpdates()
+	if err != nil {
+		s.mutex.Unlock()
+		return &ServiceError{ErrDatabase, err.Error()}
+	}
+	packages := list.New()
 	for _, v := range updPkgs {
 		if stringInList(s.ignoredPackageNames, v.Name) {
 			continue
 		}
-		s.packages.PushBack(v)
+		packages.PushBack(v)
 	}
+	s.setPackages(packages)
 	s.mutex.Unlock()
 	log.Infoln("Repo update finished")
+	s.notifyListeners("update_finished")
+	return nil
 }
 
 // The message processor callback
@@ -298,7 +632,7 @@ func (s *RepoService) processMsg(msg string) {
 	switch tmsg[0] {
 	case "sync_finished":
 		log.Debugln("RepoService: sync_finished event")
-		s.repoExecuteCB()
+		s.run()
 	case "fs_event":
 		if len(tmsg) == 3 {
 			log.Debugf("RepoService: fs_event: %s %s\n", tmsg[1], tmsg[2])
@@ -307,7 +641,7 @@ func (s *RepoService) processMsg(msg string) {
 			} else if tmsg[2] == "remove" && path.Base(tmsg[1]) == "db.lck" {
 				if s.dbChanged {
 					log.Debugln("RepoService: Database changed and lock removed, updating")
-					s.repoExecuteCB()
+					s.run()
 					s.dbChanged = false
 				} else {
 					log.Debugln("RepoService: Database lock detected but no changes made")
@@ -321,49 +655,54 @@ func (s *RepoService) processMsg(msg string) {
 
 // GetData returns the local package updates and its
 // type is []*alpm.Pkg
-func (s *RepoService) GetData() interface{} {
-	var pkgs []*alpm.Pkg
-	for e := s.packages.Front(); e != nil; e = e.Next() {
-		pkgs = append(pkgs, e.Value.(*alpm.Pkg))
-	}
-	return pkgs
+func (s *RepoService) GetData() (interface{}, error) {
+	return s.packageSlice(), s.lastError()
 }
 
 // AURService is a timeout services that retrieves the
 // remote version of foreign packages and checks for updates
 type AURService struct {
 	*TimeoutService
-	packages  *list.List
+	*pkgList
 	dbChanged bool
 }
 
 // The executor callback
-func (s *AURService) aurExecuteCB(args ...string) {
+func (s *AURService) aurExecuteCB(args ...string) error {
 	log.Infof("Execute AUR Service Update\n")
 	s.mutex.Lock()
-	s.packages = s.packages.Init()
-	fpkgs := s.libalpm.GetForeign()
-	aur.UpdateRemoteVersions(fpkgs)
+	fpkgs, err := s.backend.GetForeign()
+	if err != nil {
+		s.mutex.Unlock()
+		return &ServiceError{ErrDatabase, err.Error()}
+	}
+	if len(fpkgs) != 0 {
+		if err := aur.UpdateRemoteVersions(fpkgs); err != nil {
+			s.mutex.Unlock()
+			return &ServiceError{ErrAUR, err.Error()}
+		}
+	}
+	packages := list.New()
 	for _, v := range fpkgs {
 		if v.RemoteVersion == "0" {
 			continue
 		}
 		if v.IsUpdatable() {
-			s.packages.PushBack(v)
+			packages.PushBack(v)
 		}
 	}
+	s.setPackages(packages)
 	s.mutex.Unlock()
 	log.Infoln("AUR update finished")
+	s.notifyListeners("update_finished")
+	return nil
 }
 
 // GetData returns a slice of AUR-updatable foreign packages.
-// The return type is []*alpm.Pkg
-func (s *AURService) GetData() interface{} {
-	var pkgs []*alpm.Pkg
-	for e := s.packages.Front(); e != nil; e = e.Next() {
-		pkgs = append(pkgs, e.Value.(*alpm.Pkg))
-	}
-	return pkgs
+// The return type is []*alpm.Pkg. If the last AUR query failed
+// the packages of the last successful query are returned.
+func (s *AURService) GetData() (interface{}, error) {
+	return s.packageSlice(), s.lastError()
 }
 
 // The message processor callback
@@ -372,7 +711,7 @@ func (s *AURService) processMsg(msg string) {
 	switch tmsg[0] {
 	case "sync_finished":
 		log.Debugln("RepoService: sync_finished event")
-		s.aurExecuteCB()
+		s.run()
 	case "fs_event":
 		if len(tmsg) == 3 {
 			log.Debugf("AURService: fs_event: %s %s\n", tmsg[1], tmsg[2])
@@ -381,7 +720,7 @@ func (s *AURService) processMsg(msg string) {
 			} else if tmsg[2] == "remove" && path.Base(tmsg[1]) == "db.lck" {
 				if s.dbChanged {
 					log.Debugln("AURService: Database changed and lock removed, updating")
-					s.aurExecuteCB()
+					s.run()
 					s.dbChanged = false
 				} else {
 					log.Debugln("AURService: Database lock detected but no changes made")
@@ -394,42 +733,110 @@ func (s *AURService) processMsg(msg string) {
 }
 
 // NewSyncService creates a new sync service. It requires the timeout
-// interval and a pointer to an initialized libalpm.
-func NewSyncService(timeout time.Duration, libalpm *alpm.Alpm) *SyncService {
+// interval and the backend synchronizing the databases.
+func NewSyncService(timeout time.Duration, backend alpm.Backend) *SyncService {
 	//base := &Service{msgChannel: make(chan string), running: false}
-	tservice := &TimeoutService{Timeout: timeout, libalpm: libalpm, mutex: &sync.Mutex{},
-		msgChannel: make(chan string), running: false}
+	tservice := newTimeoutService(timeout, backend)
 	//tservice := &TimeoutService{base, timeout, libalpm, &sync.Mutex{}, nil, nil, nil}
-	service := &SyncService{tservice}
+	service := &SyncService{TimeoutService: tservice, forceMutex: &sync.Mutex{},
+		jobs: make(map[int]*SyncJob)}
 	tservice.setExecuteCB(service.syncExecuteCB)
 	tservice.setMsgProcessorCB(service.processMsg)
 	return service
 }
 
+// PreviewService is a timeout service that prepares a system
+// upgrade on the sandbox without performing it
+type PreviewService struct {
+	*TimeoutService
+	preview   *alpm.Preview
+	dbChanged bool
+}
+
+// The executor callback
+func (s *PreviewService) previewExecuteCB(args ...string) error {
+	log.Infoln("Execute Preview Service Update")
+	previewer, ok := s.backend.(alpm.Previewer)
+	if !ok {
+		return &ServiceError{ErrPreview, "the backend does not support upgrade previews"}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.backend.Lock()
+	preview, err := previewer.PreviewSysupgrade()
+	s.backend.Unlock()
+	if err != nil {
+		return &ServiceError{ErrPreview, err.Error()}
+	}
+	s.preview = preview
+	log.Infoln("Preview update finished")
+	return nil
+}
+
+// The message processor callback
+func (s *PreviewService) processMsg(msg string) {
+	tmsg := strings.Split(msg, ";;")
+	switch tmsg[0] {
+	case "sync_finished":
+		log.Debugln("PreviewService: sync_finished event")
+		s.run()
+	case "fs_event":
+		if len(tmsg) == 3 {
+			log.Debugf("PreviewService: fs_event: %s %s\n", tmsg[1], tmsg[2])
+			if path.Base(tmsg[1]) != "db.lck" {
+				s.dbChanged = true
+			} else if tmsg[2] == "remove" && s.dbChanged {
+				log.Debugln("PreviewService: Database changed and lock removed, updating")
+				s.run()
+				s.dbChanged = false
+			}
+		}
+	default:
+		return
+	}
+}
+
+// GetData returns the outcome of the last preview as *alpm.Preview,
+// nil before the first successful run
+func (s *PreviewService) GetData() (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.preview, s.lastError()
+}
+
 // NewRepoService creates a new repo service. It requires the timeout
-// interval, a pointer to an initialized libalpm and the pacman.conf
+// interval, the backend reading the databases and the pacman.conf
 // configuration map.
-func NewRepoService(timeout time.Duration, libalpm *alpm.Alpm,
+func NewRepoService(timeout time.Duration, backend alpm.Backend,
 	conf map[string]map[string]interface{}) *RepoService {
-	tservice := &TimeoutService{Timeout: timeout, libalpm: libalpm, mutex: &sync.Mutex{},
-		msgChannel: make(chan string), running: false, conf: conf}
-	service := &RepoService{tservice, list.New(), libalpm.GetIgnoredPackageNames(conf), false}
+	tservice := newTimeoutService(timeout, backend)
+	tservice.conf = conf
+	service := &RepoService{tservice, newPkgList(), backend.GetIgnoredPackageNames(conf), false}
 	tservice.setExecuteCB(service.repoExecuteCB)
 	tservice.setMsgProcessorCB(service.processMsg)
 	return service
 }
 
 // NewAURService creates a new AUR service. It requires the timeout
-// interval and a pointer to an initialized libalpm.
-func NewAURService(timeout time.Duration, libalpm *alpm.Alpm) *AURService {
-	tservice := &TimeoutService{Timeout: timeout, libalpm: libalpm, mutex: &sync.Mutex{},
-		msgChannel: make(chan string), running: false}
-	service := &AURService{tservice, list.New(), false}
+// interval and the backend reading the databases.
+func NewAURService(timeout time.Duration, backend alpm.Backend) *AURService {
+	tservice := newTimeoutService(timeout, backend)
+	service := &AURService{tservice, newPkgList(), false}
 	tservice.setExecuteCB(service.aurExecuteCB)
 	tservice.setMsgProcessorCB(service.processMsg)
 	return service
 }
 
+// NewPreviewService creates a new preview service. It requires the
+// timeout interval and a backend implementing alpm.Previewer.
+func NewPreviewService(timeout time.Duration, backend alpm.Backend) *PreviewService {
+	tservice := newTimeoutService(timeout, backend)
+	service := &PreviewService{tservice, nil, false}
+	tservice.setExecuteCB(service.previewExecuteCB)
+	tservice.setMsgProcessorCB(service.processMsg)
+	return service
+}
+
 // NewFSWatchService creates a new filesystem watch service. It requires
 // a list of watched files or folders and a flag mask of events to
 // monitor, for example fsnotify.Create|fsnotify.Remove will only send
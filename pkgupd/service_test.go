@@ -0,0 +1,308 @@
+package main
+
+import "errors"
+import "reflect"
+import "testing"
+import "time"
+import "pkgupd/alpm"
+
+// eventRecorder is a listener that records the events of a service
+type eventRecorder struct {
+	events chan string
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{make(chan string, 16)}
+}
+
+// ProcessEvent implements the Listener interface
+func (r *eventRecorder) ProcessEvent(msg string) {
+	r.events <- msg
+}
+
+// expect fails unless the next event is msg
+func (r *eventRecorder) expect(t *testing.T, msg string) {
+	t.Helper()
+	select {
+	case evt := <-r.events:
+		if evt != msg {
+			t.Fatalf("expected event %s, got %s", msg, evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event %s", msg)
+	}
+}
+
+// expectNone fails if an event has been recorded
+func (r *eventRecorder) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case evt := <-r.events:
+		t.Fatalf("unexpected event %s", evt)
+	default:
+	}
+}
+
+// waitFor polls cond until it holds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the service")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pkgNames returns the names of the packages of a service
+func pkgNames(t *testing.T, s DataService) []string {
+	t.Helper()
+	data, err := s.GetData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, p := range data.([]*alpm.Pkg) {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// startService starts s and returns a function stopping it
+func startService(s DataService) func() {
+	go s.Start()
+	return func() {
+		s.Stop()
+		s.Wait()
+	}
+}
+
+func TestRepoServiceEvents(t *testing.T) {
+	backend := alpm.NewFakeBackend()
+	backend.SetGroup("kde", []string{"kate"})
+	backend.SetUpdates([]*alpm.Pkg{{Name: "linux"}, {Name: "firefox"}, {Name: "kate"}})
+	conf := map[string]map[string]interface{}{
+		"options": {"IgnorePkg": "firefox", "IgnoreGroup": "kde"}}
+	repo := NewRepoService(time.Hour, backend, conf)
+	rec := newEventRecorder()
+	repo.AddListener(rec)
+	defer startService(repo)()
+
+	rec.expect(t, "update_finished")
+	if names := pkgNames(t, repo); !reflect.DeepEqual(names, []string{"linux"}) {
+		t.Errorf("expected the ignored packages to be dropped, got %v", names)
+	}
+
+	backend.SetUpdates([]*alpm.Pkg{{Name: "linux"}, {Name: "bash"}})
+	repo.ProcessEvent("sync_finished")
+	rec.expect(t, "update_finished")
+	if names := pkgNames(t, repo); !reflect.DeepEqual(names, []string{"linux", "bash"}) {
+		t.Errorf("expected the packages of the synced databases, got %v", names)
+	}
+
+	// the packages are only read again once the lock of a changed
+	// database is removed
+	calls := backend.Calls("GetUpdates")
+	for _, evt := range []string{
+		"fs_event;;/var/lib/pacman/db.lck;;create",
+		"fs_event;;/var/lib/pacman/db.lck;;remove",
+		"fs_event;;/var/lib/pacman/db.lck;;create",
+		"fs_event;;/var/lib/pacman/local/bash-4.4-1;;create",
+		"fs_event;;/var/lib/pacman/local",
+	} {
+		repo.ProcessEvent(evt)
+	}
+	rec.expectNone(t)
+	if backend.Calls("GetUpdates") != calls {
+		t.Fatal("packages read before the database lock was removed")
+	}
+	backend.SetUpdates([]*alpm.Pkg{{Name: "linux"}})
+	repo.ProcessEvent("fs_event;;/var/lib/pacman/db.lck;;remove")
+	rec.expect(t, "update_finished")
+	if names := pkgNames(t, repo); !reflect.DeepEqual(names, []string{"linux"}) {
+		t.Errorf("expected the packages of the changed database, got %v", names)
+	}
+	repo.ProcessEvent("fs_event;;/var/lib/pacman/db.lck;;remove")
+	rec.expectNone(t)
+	if backend.Calls("GetUpdates") != calls+1 {
+		t.Error("packages read again without database changes")
+	}
+}
+
+func TestRepoServiceReadError(t *testing.T) {
+	backend := alpm.NewFakeBackend()
+	backend.SetUpdates([]*alpm.Pkg{{Name: "linux"}})
+	repo := NewRepoService(time.Hour, backend, nil)
+	rec := newEventRecorder()
+	repo.AddListener(rec)
+	defer startService(repo)()
+	rec.expect(t, "update_finished")
+
+	// a database that can not be read is an error, not an empty
+	// list of updates
+	backend.SetReadError(errors.New("could not read the local database"))
+	repo.ProcessEvent("sync_finished")
+	waitFor(t, func() bool {
+		_, err := repo.GetData()
+		return err != nil
+	})
+	data, err := repo.GetData()
+	if serr, ok := err.(*ServiceError); !ok || serr.Code != ErrDatabase {
+		t.Errorf("expected a database error, got %v", err)
+	}
+	if pkgs := data.([]*alpm.Pkg); len(pkgs) != 1 || pkgs[0].Name != "linux" {
+		t.Errorf("expected the packages of the last run, got %v", pkgs)
+	}
+	rec.expectNone(t)
+
+	backend.SetReadError(nil)
+	repo.ProcessEvent("sync_finished")
+	rec.expect(t, "update_finished")
+	if _, err = repo.GetData(); err != nil {
+		t.Errorf("expected the error to be cleared, got %v", err)
+	}
+}
+
+func TestRepoServiceConcurrentGetData(t *testing.T) {
+	backend := alpm.NewFakeBackend()
+	backend.SetUpdates([]*alpm.Pkg{{Name: "linux"}, {Name: "bash"}, {Name: "glibc"}})
+	repo := NewRepoService(time.Hour, backend, nil)
+	rec := newEventRecorder()
+	repo.AddListener(rec)
+	defer startService(repo)()
+	rec.expect(t, "update_finished")
+
+	// readers only ever see complete package lists while the
+	// service rebuilds them
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if names := pkgNames(t, repo); len(names) != 3 {
+				t.Errorf("expected a complete package list, got %v", names)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		repo.ProcessEvent("sync_finished")
+		rec.expect(t, "update_finished")
+	}
+	<-done
+}
+
+func TestAURServiceEvents(t *testing.T) {
+	backend := alpm.NewFakeBackend()
+	aur := NewAURService(time.Hour, backend)
+	rec := newEventRecorder()
+	aur.AddListener(rec)
+	defer startService(aur)()
+
+	rec.expect(t, "update_finished")
+	if names := pkgNames(t, aur); len(names) != 0 {
+		t.Errorf("expected no updates without foreign packages, got %v", names)
+	}
+	aur.ProcessEvent("fs_event;;/var/lib/pacman/local/yaourt-1.8.1-1;;create")
+	aur.ProcessEvent("fs_event;;/var/lib/pacman/db.lck;;remove")
+	rec.expect(t, "update_finished")
+	if backend.Calls("GetForeign") != 2 {
+		t.Errorf("expected 2 reads of the foreign packages, got %d", backend.Calls("GetForeign"))
+	}
+}
+
+func TestSyncServiceEvents(t *testing.T) {
+	backend := alpm.NewFakeBackend()
+	backend.SetUpdates([]*alpm.Pkg{{Name: "linux"}})
+	syncService := NewSyncService(time.Hour, backend)
+	syncService.MinForceInterval = 0
+	repo := NewRepoService(time.Hour, backend, nil)
+	syncService.AddListener(repo)
+	rec := newEventRecorder()
+	syncService.AddListener(rec)
+	repoRec := newEventRecorder()
+	repo.AddListener(repoRec)
+	defer startService(repo)()
+	repoRec.expect(t, "update_finished")
+	defer startService(syncService)()
+
+	// the initial sync changes nothing and notifies nobody
+	waitFor(t, func() bool { return syncService.GetStatus().LastEnd != nil })
+	rec.expectNone(t)
+
+	// a forced sync that changed the databases updates the listeners
+	// before its job is done
+	backend.SetSyncResult([]*alpm.DBSyncResult{
+		{Name: "core", State: alpm.DBUpdated, Server: "http://mirror/core/os/x86_64",
+			Downloaded: 1024, Duration: 0.5},
+		{Name: "extra", State: alpm.DBUpToDate, Server: "http://mirror/extra/os/x86_64", Duration: 0.1}}, nil)
+	backend.SetUpdates([]*alpm.Pkg{{Name: "linux"}, {Name: "bash"}})
+	res := syncService.RequestSync()
+	if res.Status != SyncStarted {
+		t.Fatalf("expected a started sync, got %s", res.Status)
+	}
+	<-syncService.Job(res.Job).Done()
+	rec.expect(t, "sync_finished")
+	repoRec.expect(t, "update_finished")
+	if job := syncService.Job(res.Job); job.State != JobFinished {
+		t.Errorf("expected a finished job, got %s", job.State)
+	}
+	if names := pkgNames(t, repo); !reflect.DeepEqual(names, []string{"linux", "bash"}) {
+		t.Errorf("expected the packages of the synced databases, got %v", names)
+	}
+	data, err := syncService.GetData()
+	if results := data.([]*alpm.DBSyncResult); err != nil || len(results) != 2 ||
+		results[0].Server != "http://mirror/core/os/x86_64" {
+		t.Errorf("expected the results of the sync, got %v, %v", data, err)
+	}
+
+	// a failed sync notifies nobody and fails the job
+	failed := []*alpm.DBSyncResult{
+		{Name: "core", State: alpm.DBFailed, Error: "mirror down",
+			Server: "http://mirror/core/os/x86_64", Duration: 5},
+		{Name: "extra", State: alpm.DBUpToDate, Server: "http://mirror/extra/os/x86_64", Duration: 0.1}}
+	backend.SetSyncResult(failed, errors.New("failed to synchronize core (mirror down)"))
+	res = syncService.RequestSync()
+	<-syncService.Job(res.Job).Done()
+	rec.expectNone(t)
+	repoRec.expectNone(t)
+	if job := syncService.Job(res.Job); job.State != JobFailed ||
+		job.Error != "failed to synchronize core (mirror down)" {
+		t.Errorf("expected a failed job, got %+v", job)
+	}
+	data, err = syncService.GetData()
+	if serr, ok := err.(*ServiceError); !ok || serr.Code != ErrSync {
+		t.Errorf("expected a sync error, got %v", err)
+	}
+	if !reflect.DeepEqual(data, failed) {
+		t.Errorf("expected the results of the failed sync, got %v", data)
+	}
+
+	// databases updated before another one failed are still reported
+	backend.SetSyncResult([]*alpm.DBSyncResult{
+		{Name: "extra", State: alpm.DBUpdated, Server: "http://mirror/extra/os/x86_64",
+			Downloaded: 2048, Duration: 0.5}, failed[0]},
+		errors.New("failed to synchronize core (mirror down)"))
+	res = syncService.RequestSync()
+	<-syncService.Job(res.Job).Done()
+	rec.expect(t, "sync_finished")
+	repoRec.expect(t, "update_finished")
+	if backend.Calls("SyncDBs") != 4 {
+		t.Errorf("expected 4 syncs, got %d", backend.Calls("SyncDBs"))
+	}
+}
+
+func TestPreviewServiceUnsupported(t *testing.T) {
+	// the fake backend can not preview upgrades
+	preview := NewPreviewService(time.Hour, alpm.NewFakeBackend())
+	defer startService(preview)()
+
+	waitFor(t, func() bool { return preview.GetStatus().LastEnd != nil })
+	data, err := preview.GetData()
+	if serr, ok := err.(*ServiceError); !ok || serr.Code != ErrPreview {
+		t.Errorf("expected a preview error, got %v", err)
+	}
+	if data.(*alpm.Preview) != nil {
+		t.Errorf("expected no preview, got %v", data)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import "encoding/json"
+import "io/ioutil"
+import "os"
+import "sync"
+import "pkgupd/alpm"
+import "pkgupd/log"
+
+// Number of snapshots kept per service. Changes since older
+// tokens can not be computed
+const MaxSnapshots = 16
+
+// Snapshot is a result set of a service tagged with the token it
+// was recorded with
+type Snapshot struct {
+	Token    uint64      `json:"Token"`
+	Packages []*alpm.Pkg `json:"Packages"`
+}
+
+// snapshotHistory holds the most recent snapshots of a service,
+// oldest first. Pruned is set once a snapshot has been dropped
+type snapshotHistory struct {
+	Pruned    bool        `json:"Pruned"`
+	Snapshots []*Snapshot `json:"Snapshots"`
+}
+
+// ChangeSet is the difference between two snapshots of a service
+type ChangeSet struct {
+	Added   []*alpm.Pkg `json:"Added"`
+	Removed []*alpm.Pkg `json:"Removed"`
+	Changed []*alpm.Pkg `json:"Changed"`
+}
+
+// snapshotStore versions the result sets of the services with a
+// single monotonically increasing token. If a path is set the store
+// is saved after every change so that tokens survive restarts
+type snapshotStore struct {
+	Token    uint64                      `json:"Token"`
+	Services map[string]*snapshotHistory `json:"Services"`
+	path     string
+	mutex    *sync.Mutex
+}
+
+func newSnapshotStore() *snapshotStore {
+	return &snapshotStore{0, make(map[string]*snapshotHistory), "", &sync.Mutex{}}
+}
+
+// load reads the store from path and saves all further changes
+// there. A missing file is not an error
+func (st *snapshotStore) load(path string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := &snapshotStore{}
+	if err = json.Unmarshal(data, saved); err != nil {
+		return err
+	}
+	st.Token = saved.Token
+	if saved.Services != nil {
+		st.Services = saved.Services
+	}
+	return nil
+}
+
+// save writes the store to its path. The caller must hold the mutex
+func (st *snapshotStore) save() {
+	if st.path == "" {
+		return
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		log.Errorln("Could not marshal snapshots:", err)
+		return
+	}
+	tmp := st.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+		err = os.Rename(tmp, st.path)
+	}
+	if err != nil {
+		log.Warnln("Could not save snapshots:", err)
+	}
+}
+
+// latest returns the most recent snapshot of the service. The caller
+// must hold the mutex
+func (st *snapshotStore) latest(key string) *Snapshot {
+	h, ok := st.Services[key]
+	if !ok || len(h.Snapshots) == 0 {
+		return nil
+	}
+	return h.Snapshots[len(h.Snapshots)-1]
+}
+
+// record stores pkgs as the new result set of the service. If it
+// differs from the previous one a new token is issued. It returns
+// the changes and the current token
+func (st *snapshotStore) record(key string, pkgs []*alpm.Pkg) (*ChangeSet, uint64) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	var old []*alpm.Pkg
+	last := st.latest(key)
+	if last != nil {
+		old = last.Packages
+	}
+	added, removed, changed := diffPkgLists(old, pkgs)
+	if last != nil && len(added) == 0 && len(removed) == 0 && len(changed) == 0 {
+		return &ChangeSet{}, st.Token
+	}
+	st.Token++
+	h, ok := st.Services[key]
+	if !ok {
+		h = &snapshotHistory{}
+		st.Services[key] = h
+	}
+	h.Snapshots = append(h.Snapshots, &Snapshot{st.Token, pkgs})
+	if len(h.Snapshots) > MaxSnapshots {
+		h.Snapshots = h.Snapshots[len(h.Snapshots)-MaxSnapshots:]
+		h.Pruned = true
+	}
+	st.save()
+	return &ChangeSet{added, removed, changed}, st.Token
+}
+
+// changes returns the changes of the services since the snapshots
+// that were current at token since, along with the current token.
+// Services for which the token is unknown or too old to compute the
+// changes map to nil
+func (st *snapshotStore) changes(keys []string, since uint64) (map[string]*ChangeSet, uint64) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	result := make(map[string]*ChangeSet)
+	for _, k := range keys {
+		result[k] = st.changeSet(k, since)
+	}
+	return result, st.Token
+}
+
+// changeSet computes the changes of a single service. The caller
+// must hold the mutex
+func (st *snapshotStore) changeSet(key string, since uint64) *ChangeSet {
+	if since > st.Token {
+		return nil
+	}
+	h, ok := st.Services[key]
+	if !ok || len(h.Snapshots) == 0 {
+		return &ChangeSet{}
+	}
+	var base []*alpm.Pkg
+	found := false
+	for _, snap := range h.Snapshots {
+		if snap.Token > since {
+			break
+		}
+		base = snap.Packages
+		found = true
+	}
+	if !found && h.Pruned && since != 0 {
+		return nil
+	}
+	added, removed, changed := diffPkgLists(base, st.latest(key).Packages)
+	return &ChangeSet{added, removed, changed}
+}
+
+// ChangesResult is the response data of a changes request. Token
+// must be sent as Since in the next changes request
+type ChangesResult struct {
+	Token   uint64                    `json:"Token"`
+	Changes map[string]*ServiceResult `json:"Changes"`
+}
+
+// SetSnapshotFile loads the snapshots saved in path and keeps saving
+// them there so that snapshot tokens survive restarts
+func (s *Server) SetSnapshotFile(path string) error {
+	return s.snapshots.load(path)
+}
+
+// changesRequest returns the packages added, removed or changed in
+// the requested services (or all services) since the snapshot token
+// of the request. A token of 0 returns all packages as added
+func (s *Server) changesRequest(c *client, req *Request, version int) *Response {
+	keys := req.Services
+	if len(keys) == 0 {
+		for k := range s.services {
+			if k != "sync" {
+				keys = append(keys, k)
+			}
+		}
+	}
+	var allowed []string
+	results := make(map[string]*ServiceResult)
+	for _, k := range keys {
+		if _, ok := s.services[k]; !ok {
+			results[k] = &ServiceResult{Status: "error", Code: ErrUnknownService,
+				Error: "unknown service " + k}
+		} else if c != nil && !c.allows(k) {
+			results[k] = &ServiceResult{Status: "error", Code: ErrForbidden,
+				Error: "not allowed"}
+		} else {
+			allowed = append(allowed, k)
+		}
+	}
+	changes, token := s.snapshots.changes(allowed, req.Since)
+	for k, cs := range changes {
+		if cs == nil {
+			results[k] = &ServiceResult{Status: "error", Code: ErrExpiredToken,
+				Error: "snapshot token expired, request changes since 0"}
+		} else {
+			results[k] = &ServiceResult{Status: "ok", Data: cs}
+		}
+	}
+	if version < 2 {
+		for _, r := range results {
+			r.Code = ""
+		}
+	}
+	return newResponse(version, &ChangesResult{token, results})
+}
@@ -0,0 +1,63 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "path"
+import "strconv"
+import "testing"
+import "pkgupd/alpm"
+
+func TestSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgupd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "snapshots.json")
+
+	st := newSnapshotStore()
+	if err = st.load(file); err != nil {
+		t.Fatal(err)
+	}
+	linux := &alpm.Pkg{Name: "linux", LocalVersion: "4.7.1-1", RemoteVersion: "4.7.2-1"}
+	linux2 := &alpm.Pkg{Name: "linux", LocalVersion: "4.7.1-1", RemoteVersion: "4.7.3-1"}
+	vim := &alpm.Pkg{Name: "vim", LocalVersion: "7.4-1", RemoteVersion: "8.0-1"}
+
+	_, first := st.record("repo", []*alpm.Pkg{linux})
+	_, second := st.record("repo", []*alpm.Pkg{linux, vim})
+	if _, token := st.record("repo", []*alpm.Pkg{linux, vim}); token != second {
+		t.Error("unchanged results should not issue a new token")
+	}
+	cs, third := st.record("repo", []*alpm.Pkg{linux2})
+	if len(cs.Changed) != 1 || len(cs.Removed) != 1 || third <= second || second <= first {
+		t.Errorf("unexpected change set %+v", cs)
+	}
+
+	// tokens and snapshots survive a restart
+	st = newSnapshotStore()
+	if err = st.load(file); err != nil {
+		t.Fatal(err)
+	}
+	changes, token := st.changes([]string{"repo"}, first)
+	if token != third {
+		t.Errorf("token %d, want %d", token, third)
+	}
+	cs = changes["repo"]
+	if cs == nil || len(cs.Added) != 0 || len(cs.Removed) != 0 || len(cs.Changed) != 1 {
+		t.Errorf("unexpected changes since %d: %+v", first, cs)
+	}
+	changes, _ = st.changes([]string{"repo"}, 0)
+	if cs = changes["repo"]; cs == nil || len(cs.Added) != 1 {
+		t.Errorf("unexpected changes since 0: %+v", cs)
+	}
+	if changes, _ = st.changes([]string{"repo"}, third+1); changes["repo"] != nil {
+		t.Error("unknown token should be expired")
+	}
+
+	for i := 0; i < MaxSnapshots; i++ {
+		st.record("repo", []*alpm.Pkg{{Name: "linux", RemoteVersion: strconv.Itoa(i)}})
+	}
+	if changes, _ = st.changes([]string{"repo"}, first); changes["repo"] != nil {
+		t.Error("pruned token should be expired")
+	}
+}
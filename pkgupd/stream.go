@@ -0,0 +1,244 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+import "pkgupd/log"
+import "github.com/gorilla/websocket"
+
+// Interval between heartbeats on SSE and websocket streams
+const HeartbeatInterval = 30 * time.Second
+
+// Heartbeat is sent on event streams when they are opened and then
+// every HeartbeatInterval. Token is the current snapshot token
+type Heartbeat struct {
+	Token uint64 `json:"Token"`
+}
+
+// eventStream follows the snapshots of some services on behalf of
+// an SSE or websocket client. token is the snapshot token up to
+// which the client has received the changes
+type eventStream struct {
+	server   *Server
+	services []string
+	version  int
+	token    uint64
+	wake     chan bool
+}
+
+// ProcessEvent implements the Listener interface and wakes up the
+// stream when the results of a service changed
+func (st *eventStream) ProcessEvent(msg string) {
+	if !strings.HasPrefix(msg, "updates_changed;;") {
+		return
+	}
+	select {
+	case st.wake <- true:
+	default:
+	}
+}
+
+// newEventStream creates a stream for the service and since query
+// parameters of the request. A stream without a token starts at
+// the current snapshot. On failure the error response is written
+// and nil is returned
+func (s *Server) newEventStream(w http.ResponseWriter, r *http.Request, version int,
+	since string) *eventStream {
+	keys := splitList(r.URL.Query()["service"])
+	for _, k := range keys {
+		if _, ok := s.services[k]; !ok || k == "sync" {
+			writeAPIResponse(w, http.StatusNotFound,
+				newErrorResponse(version, ErrUnknownService, "unknown service "+k))
+			return nil
+		}
+		if !s.apiAllowed(w, r, version, k) {
+			return nil
+		}
+	}
+	if len(keys) == 0 {
+		// Services the client may not read are left out
+		c := s.apiClient(r)
+		for k := range s.services {
+			if k != "sync" && c.allows(k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	st := &eventStream{s, keys, version, 0, make(chan bool, 1)}
+	if since == "" {
+		_, st.token = s.snapshots.changes(nil, 0)
+		return st
+	}
+	token, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		writeAPIResponse(w, http.StatusBadRequest,
+			newErrorResponse(version, ErrInvalidRequest, "invalid token "+since))
+		return nil
+	}
+	st.token = token
+	return st
+}
+
+// next returns the events for the changes since the stream token
+// and advances the token. If the token expired an expired_token
+// error is returned first, followed by all the packages as added
+func (st *eventStream) next() []*Response {
+	var resps []*Response
+	changes, token := st.server.snapshots.changes(st.services, st.token)
+	for _, cs := range changes {
+		if cs == nil {
+			resps = append(resps, newErrorResponse(st.version, ErrExpiredToken,
+				"snapshot token expired, resending all packages"))
+			changes, token = st.server.snapshots.changes(st.services, 0)
+			break
+		}
+	}
+	keys := make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cs := changes[k]
+		if len(cs.Added) == 0 && len(cs.Removed) == 0 && len(cs.Changed) == 0 {
+			continue
+		}
+		evt := &UpdateEvent{k, token, cs.Added, cs.Removed, cs.Changed}
+		resps = append(resps, &Response{ResponseType: "event", Version: st.version,
+			Data: dataForVersion(st.version, evt)})
+	}
+	st.token = token
+	return resps
+}
+
+// run sends the changes of the stream and heartbeats until done is
+// closed, the server stops or send fails. The responses of a batch
+// are consistent with the token passed along
+func (st *eventStream) run(done <-chan struct{},
+	send func(resps []*Response, token uint64) error) {
+	st.server.AddListener(st)
+	defer st.server.RemoveListener(st)
+	heartbeat := func() []*Response {
+		return []*Response{{ResponseType: "heartbeat", Version: st.version,
+			Data: &Heartbeat{st.token}}}
+	}
+	resps := append(st.next(), heartbeat()...)
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if err := send(resps, st.token); err != nil {
+			log.Debugln("Event stream closed:", err)
+			return
+		}
+		select {
+		case <-st.wake:
+			resps = st.next()
+		case <-ticker.C:
+			resps = heartbeat()
+		case <-done:
+			return
+		case <-st.server.closeMsg:
+			return
+		}
+	}
+}
+
+// apiEvents answers GET /v1/events with a Server-Sent Events stream.
+// Every message carries the snapshot token as its id so that
+// EventSource resumes from Last-Event-ID after a reconnect
+func (s *Server) apiEvents(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "GET")
+	if !ok {
+		return
+	}
+	if !s.apiAllowed(w, r, version, "subscribe") {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIResponse(w, http.StatusInternalServerError,
+			newErrorResponse(version, ErrInternal, "streaming not supported"))
+		return
+	}
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	st := s.newEventStream(w, r, version, since)
+	if st == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	st.run(r.Context().Done(), func(resps []*Response, token uint64) error {
+		for i, resp := range resps {
+			data, err := json.Marshal(resp)
+			if err != nil {
+				return err
+			}
+			if i == len(resps)-1 {
+				fmt.Fprintf(w, "id: %d\n", token)
+			}
+			if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+		return nil
+	})
+}
+
+// wsUpgrader only accepts websocket connections from pages served
+// by the same origin
+var wsUpgrader = websocket.Upgrader{}
+
+// apiWebSocket answers GET /v1/ws with a websocket that streams the
+// same messages as /v1/events, one JSON message per frame. Clients
+// resume with the since query parameter
+func (s *Server) apiWebSocket(w http.ResponseWriter, r *http.Request) {
+	version, ok := apiVersion(w, r, "GET")
+	if !ok {
+		return
+	}
+	if !s.apiAllowed(w, r, version, "subscribe") {
+		return
+	}
+	st := s.newEventStream(w, r, version, r.URL.Query().Get("since"))
+	if st == nil {
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debugln("Websocket upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+	// Messages from the client are discarded, reading is required
+	// to process pings and to notice closed connections
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	st.run(done, func(resps []*Response, token uint64) error {
+		for _, resp := range resps {
+			conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			if err := conn.WriteJSON(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+}
@@ -0,0 +1,161 @@
+package main
+
+import "bufio"
+import "context"
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "strconv"
+import "strings"
+import "sync"
+import "testing"
+import "pkgupd/alpm"
+import "github.com/gorilla/websocket"
+
+// streamMessage is a decoded message of an event stream. The data
+// of events is decoded into Event
+type streamMessage struct {
+	ResponseType string
+	Code         string
+	Data         json.RawMessage
+	Event        UpdateEvent
+}
+
+func decodeStreamMessage(t *testing.T, data []byte) *streamMessage {
+	msg := &streamMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ResponseType == "event" {
+		if err := json.Unmarshal(msg.Data, &msg.Event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return msg
+}
+
+// readSSE reads the next message of an SSE stream and its id
+func readSSE(t *testing.T, r *bufio.Reader) (*streamMessage, string) {
+	var msg *streamMessage
+	id := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return msg, id
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			msg = decodeStreamMessage(t, []byte(line[6:]))
+		}
+	}
+}
+
+func TestEventStreams(t *testing.T) {
+	server := NewServer(false)
+	repo := &staticService{mutex: &sync.Mutex{}}
+	server.AddService("repo", repo)
+	ts := httptest.NewServer(server.apiHandler())
+	defer ts.Close()
+	defer server.Stop()
+
+	resp, err := http.Get(ts.URL + APIPrefix + "events?service=repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	if msg, id := readSSE(t, r); msg.ResponseType != "heartbeat" || id != "0" {
+		t.Fatalf("expected initial heartbeat, got %+v with id %s", msg, id)
+	}
+
+	repo.update([]*alpm.Pkg{{Name: "linux", LocalVersion: "4.7.1-1",
+		RemoteVersion: "4.7.2-1", Repo: "core"}})
+	msg, id := readSSE(t, r)
+	if msg.ResponseType != "event" || msg.Event.Service != "repo" ||
+		len(msg.Event.Added) != 1 || id != strconv.FormatUint(msg.Event.Token, 10) {
+		t.Fatalf("unexpected event %+v with id %s", msg, id)
+	}
+	resp.Body.Close()
+
+	// Resume from the first token, the second change must be replayed
+	repo.update(append(repo.data, &alpm.Pkg{Name: "firefox",
+		LocalVersion: "48.0-1", RemoteVersion: "49.0-1", Repo: "extra"}))
+	req, _ := http.NewRequest("GET", ts.URL+APIPrefix+"events", nil)
+	req.Header.Set("Last-Event-ID", id)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = bufio.NewReader(resp.Body)
+	msg, _ = readSSE(t, r)
+	if msg.ResponseType != "event" || len(msg.Event.Added) != 1 ||
+		msg.Event.Added[0].Name != "firefox" {
+		t.Fatalf("unexpected replayed event %+v", msg)
+	}
+	resp.Body.Close()
+
+	// A token from the future is expired and all packages are resent
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + APIPrefix + "ws?since=100"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, expect := range []string{"error", "event", "heartbeat"} {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := decodeStreamMessage(t, data)
+		if msg.ResponseType != expect {
+			t.Fatalf("expected %s, got %+v", expect, msg)
+		}
+		if expect == "error" && msg.Code != ErrExpiredToken {
+			t.Errorf("unexpected error code %s", msg.Code)
+		}
+		if expect == "event" && len(msg.Event.Added) != 2 {
+			t.Errorf("expected all packages, got %+v", msg.Event.Added)
+		}
+	}
+}
+
+func TestEventStreamPolicy(t *testing.T) {
+	server := NewServer(false)
+	server.AddService("repo", &staticService{mutex: &sync.Mutex{}})
+	server.AddService("aur", &staticService{mutex: &sync.Mutex{}})
+	server.peerPolicy = PeerPolicy{"aur": &PeerRule{}}
+	request := func(url string) *http.Request {
+		r := httptest.NewRequest("GET", url, nil)
+		return r.WithContext(context.WithValue(r.Context(), peerCredKey{},
+			&peerCred{uid: 1000}))
+	}
+
+	// streams of all services leave out the denied ones
+	w := httptest.NewRecorder()
+	st := server.newEventStream(w, request(APIPrefix+"events"), ProtocolVersion, "")
+	if st == nil || len(st.services) != 1 || st.services[0] != "repo" {
+		t.Fatalf("expected a stream of repo only, got %+v", st)
+	}
+	w = httptest.NewRecorder()
+	st = server.newEventStream(w, request(APIPrefix+"events?service=aur"), ProtocolVersion, "")
+	if st != nil || w.Code != http.StatusForbidden {
+		t.Errorf("expected a forbidden stream, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	server.apiChanges(w, request(APIPrefix+"changes?service=aur"))
+	var resp struct{ Data ChangesResult }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if res := resp.Data.Changes["aur"]; res == nil || res.Code != ErrForbidden {
+		t.Errorf("expected the aur changes to be forbidden, got %s", w.Body)
+	}
+}
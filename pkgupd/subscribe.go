@@ -0,0 +1,150 @@
+package main
+
+import "fmt"
+import "pkgupd/alpm"
+import "pkgupd/log"
+import "strings"
+
+// Number of events queued for a subscriber before new events
+// are dropped
+const SubscriberQueueLength = 32
+
+// UpdateEvent is pushed to subscribed clients when a service
+// finishes a run and its results changed. Token is the snapshot
+// token of the new results. Sync events carry no packages, they
+// only signal that the databases were updated
+type UpdateEvent struct {
+	Service string      `json:"Service"`
+	Token   uint64      `json:"Token,omitempty"`
+	Added   []*alpm.Pkg `json:"Added"`
+	Removed []*alpm.Pkg `json:"Removed"`
+	Changed []*alpm.Pkg `json:"Changed"`
+}
+
+// serviceWatcher is registered as a listener on every service of
+// the server and forwards finished runs to the subscribers
+type serviceWatcher struct {
+	server *Server
+	key    string
+}
+
+// ProcessEvent implements the Listener interface
+func (w *serviceWatcher) ProcessEvent(msg string) {
+	tmsg := strings.Split(msg, ";;")
+	switch tmsg[0] {
+	case "update_finished":
+		w.server.updateFinished(w.key)
+	case "sync_finished":
+		w.server.publish(&UpdateEvent{Service: w.key})
+	default:
+		return
+	}
+}
+
+// updateFinished records the data of service key as a new snapshot
+// and publishes the difference to the last one if there is any
+func (s *Server) updateFinished(key string) {
+	service, ok := s.services[key]
+	if !ok {
+		return
+	}
+	data, err := service.GetData()
+	if err != nil {
+		return
+	}
+	pkgs, _ := data.([]*alpm.Pkg)
+	cs, token := s.snapshots.record(key, pkgs)
+	if len(cs.Added) == 0 && len(cs.Removed) == 0 && len(cs.Changed) == 0 {
+		log.Debugf("No changes for service %s\n", key)
+		return
+	}
+	s.publish(&UpdateEvent{key, token, cs.Added, cs.Removed, cs.Changed})
+	s.notifyListeners(fmt.Sprintf("updates_changed;;%s;;%d", key, token))
+}
+
+// notifyListeners sends an event to the listeners of the server
+func (s *Server) notifyListeners(msg string) {
+	s.subMutex.Lock()
+	listeners := append([]Listener(nil), s.listeners...)
+	s.subMutex.Unlock()
+	for _, l := range listeners {
+		l.ProcessEvent(msg)
+	}
+}
+
+// publish queues the event for every client subscribed to the
+// service of the event, unless the policies of the client deny the
+// service. Slow clients lose events instead of blocking the services
+func (s *Server) publish(evt *UpdateEvent) {
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	for c := range s.subscribers {
+		if len(c.services) != 0 && !stringInList(c.services, evt.Service) {
+			continue
+		}
+		if !c.allows(evt.Service) {
+			continue
+		}
+		select {
+		case c.events <- &Response{ResponseType: "event", Version: c.version,
+			Data: dataForVersion(c.version, evt)}:
+		default:
+			log.Warnf("Event queue of %s is full, dropping event\n",
+				c.conn.RemoteAddr())
+		}
+	}
+}
+
+// subscribeRequest keeps the connection of the client open and
+// pushes an event line every time one of the requested services
+// (or all services the client is allowed to request) changes. Events
+// are queued from now on but only written by startSubscription, once
+// the reply is written
+func (s *Server) subscribeRequest(c *client, req *Request, version int) *Response {
+	for _, k := range req.Services {
+		if _, ok := s.services[k]; !ok {
+			return newErrorResponse(version, ErrUnknownService, "unknown service "+k)
+		}
+		if !c.allows(k) {
+			return newErrorResponse(version, ErrForbidden, "service "+k+" is not allowed")
+		}
+	}
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	c.version = version
+	c.services = req.Services
+	if !s.subscribers[c] {
+		c.events = make(chan *Response, SubscriberQueueLength)
+		s.subscribers[c] = true
+		c.subscribing = true
+	}
+	return newResponse(version, nil)
+}
+
+// startSubscription starts forwarding the queued events of a client
+// that just subscribed. It is called after the reply to the request
+// so that no event is written before it
+func (s *Server) startSubscription(c *client) {
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	if !c.subscribing {
+		return
+	}
+	c.subscribing = false
+	go func() {
+		for evt := range c.events {
+			c.writeEvent(evt)
+		}
+	}()
+}
+
+// unsubscribe removes the client from the subscribers, if it is
+// subscribed, and stops its event writer
+func (s *Server) unsubscribe(c *client) {
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	if s.subscribers[c] {
+		delete(s.subscribers, c)
+		close(c.events)
+	}
+}
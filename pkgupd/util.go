@@ -7,11 +7,14 @@ import "errors"
 import "fmt"
 import "strings"
 
-func testRun(libalpm *alpm.Alpm, conf map[string]map[string]interface{}) {
+func testRun(backend alpm.Backend, conf map[string]map[string]interface{}) {
 	fmt.Printf("Syncing databases.... ")
 	// Sync the databases
-	libalpm.SyncDBs(false)
-	fmt.Println("Done!")
+	if _, err := backend.SyncDBs(false); err != nil {
+		fmt.Println("Error:", err)
+	} else {
+		fmt.Println("Done!")
+	}
 
 	ignoredPkgs := []string{}
 	if val, ok := conf["options"]["IgnorePkg"].(string); ok {
@@ -26,14 +29,18 @@ func testRun(libalpm *alpm.Alpm, conf map[string]map[string]interface{}) {
 		for _, v := range strings.Split(val, " ") {
 			grp = strings.Trim(v, " \t\r\n")
 			fmt.Printf("Ignoring group '%s' packages\n", grp)
-			grpPkgs = libalpm.GetGroupPackageNames(grp)
+			grpPkgs = backend.GetGroupPackageNames(grp)
 			fmt.Println(grpPkgs)
 			ignoredPkgs = append(ignoredPkgs, grpPkgs...)
 		}
 	}
 
 	// Print local updates
-	for _, p := range libalpm.GetUpdates() {
+	updates, err := backend.GetUpdates()
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
+	for _, p := range updates {
 		if stringInList(ignoredPkgs, p.Name) {
 			fmt.Printf("[LOCAL] %s is updatable but ignored\n", p.Name)
 		} else {
@@ -42,9 +49,11 @@ func testRun(libalpm *alpm.Alpm, conf map[string]map[string]interface{}) {
 	}
 
 	// Check AUR for foreign updates
-	foreignPackages := libalpm.GetForeign()
-	if len(foreignPackages) != 0 {
-		err := aur.UpdateRemoteVersions(foreignPackages)
+	foreignPackages, err := backend.GetForeign()
+	if err != nil {
+		fmt.Println("Error:", err)
+	} else if len(foreignPackages) != 0 {
+		err = aur.UpdateRemoteVersions(foreignPackages)
 		if err != nil {
 			fmt.Println("Error:", err)
 		} else {
@@ -100,6 +109,27 @@ func findPkgInList(haystack []*alpm.Pkg, needle *alpm.Pkg) (*alpm.Pkg, error) {
 	return nil, errors.New("Package not found in slice")
 }
 
+// diffPkgLists compares two package lists and returns the packages
+// that were added to, removed from or changed version in newPkgs
+func diffPkgLists(oldPkgs []*alpm.Pkg, newPkgs []*alpm.Pkg) ([]*alpm.Pkg, []*alpm.Pkg, []*alpm.Pkg) {
+	var added, removed, changed []*alpm.Pkg
+	for _, p := range newPkgs {
+		old, err := findPkgInList(oldPkgs, p)
+		if err != nil {
+			added = append(added, p)
+		} else if old.LocalVersion != p.LocalVersion ||
+			old.RemoteVersion != p.RemoteVersion {
+			changed = append(changed, p)
+		}
+	}
+	for _, p := range oldPkgs {
+		if !pkgInList(newPkgs, p) {
+			removed = append(removed, p)
+		}
+	}
+	return added, removed, changed
+}
+
 func systemArch() string {
 	switch runtime.GOARCH {
 	case "386":
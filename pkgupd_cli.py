@@ -6,6 +6,7 @@ a number or updatable packages.
 """
 
 import socket
+import ssl
 import json
 import sys
 import argparse
@@ -68,7 +69,7 @@ def logerr(what, args, verbosity, alt=None):
     """
     _log(what, args, verbosity, alt, sys.stderr)
 
-def read_data(sock, srv, args):
+def read_data(sock, srv, args, extra=None):
     """
     Read and return json data from socket. This function only reads up
     to the first "\n" encountered and the rest of the response is discarded
@@ -77,11 +78,16 @@ def read_data(sock, srv, args):
       rsock: The socket to read from
       rsrv: The service for which the request is made
       rargs: Dommand line arguments
+      extra: Additional request fields (default: None)
 
     Returns:
       A dict containing the json results from the server
     """
     data = {'RequestType':srv}
+    if args.token is not None:
+        data['Token'] = args.token
+    if extra is not None:
+        data.update(extra)
     sock.send(bytes(json.dumps(data)+"\n", "UTF-8"))
     res = ""
     buf = ""
@@ -99,6 +105,35 @@ def read_data(sock, srv, args):
     return rret
 
 
+def query_services(sock, services, args):
+    """
+    Query all services in a single round trip
+
+    Args:
+      sock: The socket to read from
+      services: The list of services to query
+      args: Command line arguments
+
+    Returns:
+      A dict keyed by service name; values are the per-service results
+      with "Status", "Error" and "Data" keys
+    """
+    extra = {'Services': services}
+    pkg_filter = {}
+    if args.match is not None:
+        pkg_filter['Name'] = args.match
+    if args.sort is not None:
+        pkg_filter['Sort'] = args.sort
+    if pkg_filter:
+        extra['Filter'] = pkg_filter
+    ret = read_data(sock, "query", args, extra)
+    if ret["ResponseType"] == "error":
+        logerr("Server returned error for query", args, 2)
+        logerr(ret["Data"], args, 2)
+        return {}
+    return ret["Data"]
+
+
 def update_server(sock, args):
     """
     Forces a server sync update
@@ -108,29 +143,33 @@ def update_server(sock, args):
       args: Command line arguments
     """
 
-    data = {'RequestType': "sync"}
-    sock.send(bytes(json.dumps(data)+"\n", "UTF-8"))
-
     ret = read_data(sock, "sync", args)
     if ret["ResponseType"] == "error":
-        logerr("Server returned error for service %s" % srv, args, 2)
+        logerr("Server returned error for service sync", args, 2)
         logerr(ret["Data"], args, 2)
     elif ret["ResponseType"] == "ok":
-        logstd("OK", args, 1)
+        result = ret["Data"] or {}
+        status = result.get("Status")
+        if status == "throttled":
+            logstd("Sync throttled, retry in %d seconds" %\
+                    result["RetryAfter"], args, 1)
+        elif status == "joined":
+            logstd("OK, joined pending sync", args, 1)
+        else:
+            logstd("OK", args, 1)
     else:
         logerr("Unknown response type", args, 2)
 
 
-def process_data_normal(sock, srv, args):
+def process_data_normal(results, srv, args):
     """
-    Reads data from server found at rsock for service rsrv and prints
-    a formatted list of the results. Depending on the verbosity level
-    of rargs the output can be just a list of names or a more detailed
-    list that includes versions as well
+    Prints a formatted list of the query results for service srv.
+    Depending on the verbosity level of args the output can be just a
+    list of names or a more detailed list that includes versions as well
 
     Args:
-      sock: The socket to read from
-      srv: The service for which the request is made
+      results: The query results as returned by query_services
+      srv: The service to print
       args: Command line arguments
     """
     verbose_color = "[%s%%s%s] %s%%s%s %s%%s%s -> %s%%s%s"%\
@@ -152,15 +191,18 @@ def process_data_normal(sock, srv, args):
         else:
             lformat = normal_simple
 
-    logerr("Getting data for service %s"%srv, args, 2)
-
-    ret = read_data(sock, srv, args)
-    if ret["Data"] is None:
-        logerr("No updates for service %s"%srv, args, 2)
-    elif ret["ResponseType"] == "error":
+    ret = results.get(srv)
+    if ret is None:
+        logerr("No results for service %s"%srv, args, 2)
+    elif ret["Status"] == "error":
         logerr("Server returned error for service %s"%srv, args, 2)
-        logerr(ret["Data"], args, 2)
+        logerr(ret["Error"], args, 2)
+    elif ret["Data"] is None:
+        logerr("No updates for service %s"%srv, args, 2)
     else:
+        for warning in ret.get("Warnings") or []:
+            logerr("Warning for service %s: %s"%(srv, warning["Message"]),\
+                    args, 2)
         if len(ret["Data"]) > 0:
             for item in ret["Data"]:
                 if args.verbose:
@@ -170,24 +212,23 @@ def process_data_normal(sock, srv, args):
                 else:
                     logstd(lformat%item["Name"], args, 0)
 
-def process_data_numeric(sock, srv, args):
+def process_data_numeric(results, srv, args):
     """
-    Reads data from server found at rsock for service rsrv and returns
-    a number of the resulting packages.
+    Returns the number of packages in the query results for service srv.
 
     Args:
-      rsock: The socket to read from
-      rsrv: The service for which the request is made
-      rargs: Command line arguments
+      results: The query results as returned by query_services
+      srv: The service to count
+      args: Command line arguments
 
     Returns:
       A count of the resulting packages
     """
-    ret = read_data(sock, srv, args)
-    if ret["Data"] is None:
-        return 0
-    elif ret["ResponseType"] == "error":
+    ret = results.get(srv)
+    if ret is None or ret["Status"] == "error":
         return "NA"
+    elif ret["Data"] is None:
+        return 0
     else:
         return len(ret["Data"])
 
@@ -208,6 +249,11 @@ def init_parser():
     port_help = "Port or socket for connection, default 7356 for tcp"
     sep_help = "Separator for numeric data, default is space"
     color_help = "Use color if outputing to terminal for non-numeric mode"
+    token_help = "Authentication token for tcp connections"
+    tls_help = "Use TLS for tcp connections"
+    tls_ca_help = "CA certificate used to verify the server"
+    match_help = "Only list packages whose name matches this shell glob"
+    sort_help = "Sort packages by \"name\", \"repo\" or version \"change\""
     parser = argparse.ArgumentParser()
     parser.add_argument("services", metavar="SRV", type=str, nargs="*",\
             help=service_help)
@@ -225,6 +271,16 @@ def init_parser():
             action="store", default="tcp", help=type_help)
     parser.add_argument("--port", "-p", dest="port",\
             action="store", default="7356", help=port_help)
+    parser.add_argument("--token", dest="token",\
+            action="store", default=None, help=token_help)
+    parser.add_argument("--tls", dest="tls",\
+            action="store_true", help=tls_help)
+    parser.add_argument("--tls-ca", dest="tls_ca",\
+            action="store", default=None, help=tls_ca_help)
+    parser.add_argument("--match", "-m", dest="match",\
+            action="store", default=None, help=match_help)
+    parser.add_argument("--sort", dest="sort",\
+            action="store", default=None, help=sort_help)
     return parser
 
 def main():
@@ -245,6 +301,10 @@ def main():
     if args.type == "tcp":
         try:
             sock = socket.create_connection(("localhost", int(args.port)))
+            if args.tls:
+                context = ssl.create_default_context(cafile=args.tls_ca)
+                context.check_hostname = False
+                sock = context.wrap_socket(sock)
         except OSError as exc:
             print("Cannot open connection to server; bailing out %s"%exc,\
                     file=sys.stderr)
@@ -269,14 +329,17 @@ def main():
         update_server(sock, args)
         return
 
+    logerr("Getting data for services %s"%", ".join(services), args, 2)
+    results = query_services(sock, services, args)
+
     if args.numeric:
         ret = []
         for srv in services:
-            ret.append(process_data_numeric(sock, srv, args))
+            ret.append(process_data_numeric(results, srv, args))
         print(args.separator.join([str(x) for x in ret]))
     else:
         for srv in services:
-            process_data_normal(sock, srv, args)
+            process_data_normal(results, srv, args)
 
     sock.close()
 